@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ashfame/html-knitter/htmlknitter"
+)
+
+// knitAll processes each input file into the matching output path, up to
+// opts.Concurrency files at a time, reporting failures per file. Assets are
+// shared through opts.Cache. Returns the manifest entries of the files
+// processed, in input order, the number of files that failed and the number
+// of files processed with warnings.
+func knitAll(inputs, outputs []string, opts htmlknitter.Options) (entries []manifestEntry, failed, warned int) {
+	workers := opts.Concurrency
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	start := time.Now()
+	reports := make([]*htmlknitter.Report, len(inputs))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	done := 0
+	for range min(workers, len(inputs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				reports[i] = knitOne(inputs[i], outputs[i], opts)
+
+				mu.Lock()
+				done++
+				if opts.LogLevel >= htmlknitter.LogNormal {
+					fmt.Fprintf(os.Stderr, "Processed %d/%d files\n", done, len(inputs))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range inputs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var sizeIn, sizeOut int64
+	for i, report := range reports {
+		if report == nil {
+			failed++
+			continue
+		}
+		if report.Warnings > 0 {
+			warned++
+		}
+		sizeIn += report.InputSize
+		sizeOut += report.OutputSize
+		entries = append(entries, newManifestEntry(inputs[i], outputs[i], report))
+	}
+
+	if opts.LogLevel >= htmlknitter.LogNormal {
+		fmt.Fprintf(os.Stderr, "Processed %d files (%d failed) in %s: %s in, %s out\n",
+			len(inputs), failed, time.Since(start).Round(time.Millisecond), formatSize(sizeIn), formatSize(sizeOut))
+	}
+	return entries, failed, warned
+}
+
+// knitOne processes a file of a batch, returning nil if it failed
+func knitOne(input, output string, opts htmlknitter.Options) *htmlknitter.Report {
+	if !opts.DryRun {
+		if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+			log.Printf("Failed to process %s: %v", input, err)
+			return nil
+		}
+	}
+
+	report, err := knitFile(input, output, opts)
+	if err != nil {
+		log.Printf("Failed to process %s: %v", input, err)
+		return nil
+	}
+	return report
+}
+
+// expandInputs turns the -input flag value, which may be a comma-separated
+// list of paths and globs, into the list of files to process
+func expandInputs(input string) ([]string, error) {
+	var inputs []string
+	for _, pattern := range strings.Split(input, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		// Plain paths are kept as is, so missing files get reported when processing
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input pattern %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			matches = []string{pattern}
+		}
+		inputs = append(inputs, matches...)
+	}
+
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("no input files given")
+	}
+	return inputs, nil
+}
+
+// isOutputDir reports whether output names a directory to write into rather
+// than an output file: it ends in a path separator or is a directory already
+func isOutputDir(output string) bool {
+	if strings.HasSuffix(output, "/") || strings.HasSuffix(output, string(filepath.Separator)) {
+		return true
+	}
+	info, err := os.Stat(output)
+	return err == nil && info.IsDir()
+}
+
+// outputPaths maps each input file to a file of the same name in outputDir
+func outputPaths(inputs []string, outputDir string) ([]string, error) {
+	outputs := make([]string, len(inputs))
+	seen := make(map[string]string)
+	for i, input := range inputs {
+		output := filepath.Join(outputDir, filepath.Base(input))
+		if other, ok := seen[output]; ok {
+			return nil, fmt.Errorf("input files %s and %s would both be written to %s", other, input, output)
+		}
+		seen[output] = input
+		outputs[i] = output
+	}
+	return outputs, nil
+}
+
+// suffixedPaths maps each input file to a file next to it with suffix added
+// to its name, e.g. page.html to page.knitted.html. The output of compressed
+// inputs isn't compressed, so page.html.gz maps to page.knitted.html too.
+// Inputs are never overwritten this way, that takes -in-place.
+func suffixedPaths(inputs []string, suffix string) ([]string, error) {
+	outputs := make([]string, len(inputs))
+	for i, input := range inputs {
+		name := input
+		if strings.EqualFold(filepath.Ext(name), ".gz") {
+			name = strings.TrimSuffix(name, filepath.Ext(name))
+		}
+		ext := filepath.Ext(name)
+		outputs[i] = strings.TrimSuffix(name, ext) + suffix + ext
+		if outputs[i] == input {
+			return nil, fmt.Errorf("output would overwrite input file %s, use -in-place to do so", input)
+		}
+	}
+	return outputs, nil
+}
+
+// checkOverwrites refuses outputs that are the input file they're written
+// from, which only -in-place does
+func checkOverwrites(inputs, outputs []string) error {
+	for i, input := range inputs {
+		if samePath(input, outputs[i]) {
+			return fmt.Errorf("output would overwrite input file %s, use -in-place to do so", input)
+		}
+	}
+	return nil
+}
+
+// samePath reports whether a and b name the same file, also through links
+// when both exist
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA == nil && errB == nil && absA == absB {
+		return true
+	}
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
+
+// walkDir finds every HTML file under dir and maps it to the same relative
+// path under outputDir. When outputDir lives inside dir it is skipped, so
+// earlier results aren't processed again, unless it's dir itself (files are
+// then processed in place).
+func walkDir(dir, outputDir string) ([]string, []string, error) {
+	absOutput, err := filepath.Abs(outputDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var inputs, outputs []string
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			absPath, err := filepath.Abs(path)
+			if err != nil {
+				return err
+			}
+			if absPath == absOutput && path != dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.EqualFold(filepath.Ext(path), ".html") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		inputs = append(inputs, path)
+		outputs = append(outputs, filepath.Join(outputDir, rel))
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(inputs) == 0 {
+		return nil, nil, fmt.Errorf("no HTML files found in %s", dir)
+	}
+	return inputs, outputs, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ashfame/html-knitter/htmlknitter"
+)
+
+// writeFiles writes files, keyed by slash-separated path, under dir
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// quietOptions returns options for knitAll logging nothing
+func quietOptions(t *testing.T) htmlknitter.Options {
+	saved := log.Writer()
+	t.Cleanup(func() { log.SetOutput(saved) })
+	log.SetOutput(io.Discard)
+	return htmlknitter.Options{
+		LogLevel: htmlknitter.LogQuiet,
+		Logger:   log.New(io.Discard, "", 0),
+		Cache:    htmlknitter.NewCache(),
+	}
+}
+
+func TestCheckOverwrites(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "a.html")
+	if err := os.WriteFile(input, []byte("<p>a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.html")
+	if err := os.Symlink("a.html", link); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		output string
+		refuse bool
+	}{
+		{input, true},
+		{filepath.Join(dir, "sub", "..", "a.html"), true},
+		{link, true},
+		{filepath.Join(dir, "b.html"), false},
+		{filepath.Join(dir, "sub", "a.html"), false},
+	}
+	for _, tt := range tests {
+		err := checkOverwrites([]string{input}, []string{tt.output})
+		if refused := err != nil; refused != tt.refuse {
+			t.Errorf("writing %s to %s refused: %t (%v), want %t", input, tt.output, refused, err, tt.refuse)
+		}
+	}
+}
+
+func TestOutputPaths(t *testing.T) {
+	outputs, err := outputPaths([]string{"a/x.html", "b/y.html"}, "out")
+	if want := []string{filepath.Join("out", "x.html"), filepath.Join("out", "y.html")}; err != nil || !slices.Equal(outputs, want) {
+		t.Errorf("got %v (%v), want %v", outputs, err, want)
+	}
+	if _, err := outputPaths([]string{"a/x.html", "b/x.html"}, "out"); err == nil {
+		t.Error("inputs with the same name written to the same output")
+	}
+}
+
+func TestKnitAll(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.html": `<img src="a.png" alt="">`,
+		"b.html": `<img src="a.png" alt=""><img src="missing.png" alt="">`,
+		"a.png":  "image a",
+	})
+	inputs := []string{filepath.Join(dir, "a.html"), filepath.Join(dir, "b.html"), filepath.Join(dir, "missing.html")}
+	outputs, err := outputPaths(inputs, filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, failed, warned := knitAll(inputs, outputs, quietOptions(t))
+	if len(entries) != 2 || failed != 1 || warned != 1 {
+		t.Errorf("got %d entries, %d failed, %d with warnings, want 2, 1 and 1", len(entries), failed, warned)
+	}
+	want := `src="data:image/png;base64,` + base64.StdEncoding.EncodeToString([]byte("image a")) + `"`
+	for _, output := range outputs[:2] {
+		data, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), want) {
+			t.Errorf("%s lacks %s:\n%s", output, want, data)
+		}
+	}
+	if _, err := os.Stat(outputs[2]); !os.IsNotExist(err) {
+		t.Errorf("output written for a missing input: %v", err)
+	}
+}
+
+func TestWalkDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"index.html":           `<link rel="stylesheet" href="css/site.css">`,
+		"blog/post.html":       `<link rel="stylesheet" href="../css/site.css">`,
+		"css/site.css":         ".a{color:red}",
+		"notes.txt":            "not HTML",
+		"knitted/earlier.html": "output of an earlier run",
+	})
+
+	inputs, outputs, err := walkDir(dir, filepath.Join(dir, "knitted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantInputs := []string{filepath.Join(dir, "blog", "post.html"), filepath.Join(dir, "index.html")}
+	wantOutputs := []string{filepath.Join(dir, "knitted", "blog", "post.html"), filepath.Join(dir, "knitted", "index.html")}
+	if !slices.Equal(inputs, wantInputs) || !slices.Equal(outputs, wantOutputs) {
+		t.Fatalf("got %v -> %v, want %v -> %v", inputs, outputs, wantInputs, wantOutputs)
+	}
+
+	// Pages may use the assets of the whole tree, as with -dir
+	opts := quietOptions(t)
+	opts.AllowedDirs = []string{dir}
+	if _, failed, warned := knitAll(inputs, outputs, opts); failed != 0 || warned != 0 {
+		t.Fatalf("%d failed, %d with warnings", failed, warned)
+	}
+	for _, output := range outputs {
+		data, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "<style") || !strings.Contains(string(data), ".a{color:red}") {
+			t.Errorf("stylesheet not inlined into %s:\n%s", output, data)
+		}
+	}
+}
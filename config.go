@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfig reads the flag values from a JSON or YAML config file, whose keys
+// are flag names (e.g. "remove-js": true, "remove-tag": ["iframe"]). Flags
+// given on the command line take precedence over the file, which takes
+// precedence over the defaults. Unknown keys are rejected.
+func loadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file %s: %w", path, err)
+	}
+
+	values := make(map[string]any)
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&values)
+	} else {
+		// YAML, which covers JSON as well
+		err = yaml.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	// Flags given on the command line win
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	// Apply the values in a stable order, so errors are reproducible
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := flag.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("error in config file %s: unknown option %q", path, name)
+		}
+		if set[name] {
+			continue
+		}
+
+		list, isList := values[name].([]any)
+		if !isList {
+			list = []any{values[name]}
+		} else if _, repeatable := f.Value.(*stringList); !repeatable {
+			return fmt.Errorf("error in config file %s: option %q takes a single value", path, name)
+		}
+		for _, value := range list {
+			// Set through the flag package, so the flag counts as given
+			if err := flag.Set(name, fmt.Sprint(value)); err != nil {
+				return fmt.Errorf("error in config file %s: invalid value %v for %q: %w", path, value, name, err)
+			}
+		}
+	}
+	return nil
+}
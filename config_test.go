@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// configFlags holds a few of the flags main defines
+type configFlags struct {
+	removeJS    *bool
+	output      *string
+	concurrency *int
+	removeTags  stringList
+}
+
+// parseFlags replaces the command line flags with configFlags for the rest of
+// the test and parses args
+func parseFlags(t *testing.T, args ...string) *configFlags {
+	t.Helper()
+	saved := flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = saved })
+	flag.CommandLine = flag.NewFlagSet("html-knitter", flag.ContinueOnError)
+
+	f := &configFlags{
+		removeJS:    flag.Bool("remove-js", false, ""),
+		output:      flag.String("output", "", ""),
+		concurrency: flag.Int("concurrency", 0, ""),
+	}
+	flag.Var(&f.removeTags, "remove-tag", "")
+	flag.String("config", "", "")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// writeConfig writes a config file with the given name and content
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	configs := map[string]string{
+		"config.json": `{"remove-js": true, "output": "file.html", "concurrency": 4, "remove-tag": ["iframe", ".ad"]}`,
+		"config.yaml": "remove-js: true\noutput: file.html\nconcurrency: 4\nremove-tag:\n  - iframe\n  - .ad\n",
+	}
+	for name, content := range configs {
+		t.Run(name, func(t *testing.T) {
+			// Flags given on the command line win
+			f := parseFlags(t, "-output", "cli.html")
+			if err := loadConfig(writeConfig(t, name, content)); err != nil {
+				t.Fatal(err)
+			}
+			if !*f.removeJS || *f.output != "cli.html" || *f.concurrency != 4 || !slices.Equal(f.removeTags, stringList{"iframe", ".ad"}) {
+				t.Errorf("got remove-js=%t output=%s concurrency=%d remove-tag=%v", *f.removeJS, *f.output, *f.concurrency, f.removeTags)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		content, want string
+	}{
+		{`{"remove-javascript": true}`, `unknown option "remove-javascript"`},
+		{`{"config": "other.json"}`, `unknown option "config"`},
+		{`{"output": ["a.html", "b.html"]}`, `option "output" takes a single value`},
+		{`{"concurrency": "many"}`, `invalid value many for "concurrency"`},
+		{`{"remove-js": true,}`, "error parsing config file"},
+	}
+	for _, tt := range tests {
+		parseFlags(t)
+		err := loadConfig(writeConfig(t, "config.json", tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("loading %s: got error %v, want %s", tt.content, err, tt.want)
+		}
+	}
+}
@@ -2,4 +2,8 @@ module github.com/ashfame/html-knitter
 
 go 1.23.2
 
-require golang.org/x/net v0.30.0
+require (
+	github.com/andybalholm/brotli v1.2.5
+	golang.org/x/net v0.30.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,55 @@
+package htmlknitter
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// checkAnchors reports the links to a #fragment of the document that no
+// element has as id (or as name, for <a> elements), such as sections clipped
+// away by KeepElements. With StripDeadAnchors their href is removed instead,
+// leaving the link text.
+func checkAnchors(doc *html.Node, cfg *config) {
+	targets := make(map[string]bool)
+	var links []*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if id := getAttr(n, "id"); id != "" {
+				targets[id] = true
+			}
+			if n.Namespace == "" && (n.Data == "a" || n.Data == "area") {
+				if name := getAttr(n, "name"); n.Data == "a" && name != "" {
+					targets[name] = true
+				}
+				if strings.HasPrefix(getAttr(n, "href"), "#") {
+					links = append(links, n)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	for _, n := range links {
+		href := getAttr(n, "href")
+		fragment := href[1:]
+		// "#" and "#top" scroll to the top of the page
+		if fragment == "" || strings.EqualFold(fragment, "top") || targets[fragment] {
+			continue
+		}
+		if unescaped, err := url.PathUnescape(fragment); err == nil && targets[unescaped] {
+			continue
+		}
+		if cfg.StripDeadAnchors {
+			cfg.debugf("Removing broken anchor link %s", href)
+			removeAttr(n, "href")
+		} else {
+			cfg.warnf("Broken anchor link %s: no element has that id", href)
+		}
+	}
+}
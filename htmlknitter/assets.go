@@ -0,0 +1,581 @@
+package htmlknitter
+
+import (
+	"encoding/base64"
+	"errors"
+	"maps"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// Font formats and their MIME types
+var fontMimeTypes = map[string]string{
+	".woff2": "font/woff2",
+	".woff":  "font/woff",
+	".ttf":   "font/ttf",
+	".eot":   "application/vnd.ms-fontobject",
+	".otf":   "font/otf",
+	".ttc":   "font/collection",
+}
+
+// Image formats and their MIME types
+var imageMimeTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".svg":  "image/svg+xml",
+	".ico":  "image/x-icon",
+}
+
+// Audio/video formats and their MIME types
+var mediaMimeTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".ogv":  "video/ogg",
+	".ogg":  "audio/ogg",
+	".mp3":  "audio/mpeg",
+	".wav":  "audio/wav",
+}
+
+// Size limit for audio/video files when no MaxEmbedSize is set, media files
+// are usually too large to be worth embedding
+const defaultMaxMediaSize = 1 << 20
+
+// errTooLarge is returned for assets larger than the embed size limit
+var errTooLarge = errors.New("larger than the embed size limit")
+
+// mimeTypeMaps returns the font and image MIME type maps with the given
+// overrides applied. An override for an extension that's neither a known font
+// nor image format goes by its type: image/* types are images, the rest fonts.
+func mimeTypeMaps(overrides map[string]string) (fonts, images map[string]string) {
+	fonts = maps.Clone(fontMimeTypes)
+	images = maps.Clone(imageMimeTypes)
+	for ext, mimeType := range overrides {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		_, isFont := fonts[ext]
+		_, isImage := images[ext]
+		switch {
+		case isFont:
+			fonts[ext] = mimeType
+		case isImage, !isFont && strings.HasPrefix(mimeType, "image/"):
+			images[ext] = mimeType
+		default:
+			fonts[ext] = mimeType
+		}
+	}
+	return fonts, images
+}
+
+// Default prefix of the rooted asset paths that get embedded: all of them
+const defaultPublicPrefix = "/"
+
+// rewriteRef applies the first matching Rewrite to an asset reference found
+// in the document or a stylesheet
+func (cfg *config) rewriteRef(ref string) string {
+	for _, r := range cfg.Rewrites {
+		if rest, found := strings.CutPrefix(ref, r.From); found {
+			return r.To + rest
+		}
+	}
+	return ref
+}
+
+// resolvePath maps an asset reference to the file path it should be read from
+func resolvePath(ref string, cfg *config) string {
+	if isRemote(ref) || hasScheme(ref) {
+		return ref
+	}
+	// Query strings and fragments (e.g. cache busting ?v=abc) don't take
+	// part in locating the file
+	ref = stripQuery(ref)
+
+	// The leading slash of rooted paths is relative to the asset root rather
+	// than the filesystem root. As in browsers, ".." can't climb above it.
+	if strings.HasPrefix(ref, "/") {
+		return filepath.Join(cfg.BaseDir, filepath.FromSlash(path.Clean(ref)))
+	}
+	// Relative paths are relative to the HTML file
+	return filepath.Join(filepath.Dir(cfg.InputFile), filepath.FromSlash(ref))
+}
+
+// stripQuery returns ref without its query string and fragment
+func stripQuery(ref string) string {
+	if i := strings.IndexAny(ref, "?#"); i >= 0 {
+		return ref[:i]
+	}
+	return ref
+}
+
+// refExt returns the lowercased file extension of the path of ref
+func refExt(ref string) string {
+	return strings.ToLower(filepath.Ext(stripQuery(ref)))
+}
+
+// hasScheme reports whether ref is an absolute URL such as data:... or
+// mailto:..., rather than a path
+func hasScheme(ref string) bool {
+	scheme, _, found := strings.Cut(ref, ":")
+	if !found || scheme == "" {
+		return false
+	}
+	for i, c := range scheme {
+		isLetter := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if !isLetter && (i == 0 || !(c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.')) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeRef resolves ref so references to the same asset compare equal
+func normalizeRef(ref string, cfg *config) string {
+	path := resolvePath(ref, cfg)
+	if isRemote(path) {
+		return path
+	}
+	return filepath.Clean(path)
+}
+
+// embedImage embeds the images referenced by an <img> or <input type="image">
+// element, or by a <source> element of a <picture>
+func embedImage(n *html.Node, cfg *config) {
+	embedded := false
+	for i, a := range n.Attr {
+		switch a.Key {
+		case "src":
+			// The src of a <source> element points to audio/video
+			if n.Data == "source" {
+				continue
+			}
+			if dataURL, ok := imageDataURL(a.Val, cfg); ok {
+				n.Attr[i].Val = dataURL
+				embedded = true
+			}
+		case "srcset":
+			n.Attr[i].Val = embedSrcset(a.Val, cfg)
+		}
+	}
+	if embedded {
+		removeFetchAttributes(n)
+	}
+}
+
+// embedIcon embeds the icon referenced by a <link rel="icon"> (or touch icon)
+// element
+func embedIcon(n *html.Node, cfg *config) {
+	for i, a := range n.Attr {
+		if a.Key != "href" {
+			continue
+		}
+		if dataURL, ok := imageDataURL(a.Val, cfg); ok {
+			n.Attr[i].Val = dataURL
+			removeFetchAttributes(n)
+			return
+		}
+	}
+}
+
+// embedMedia embeds the poster image and the audio/video file referenced by a
+// <video> or <audio> element, or by a <source> element of one. Media files
+// are only embedded when EmbedMedia is set and they're within the size limit.
+func embedMedia(n *html.Node, cfg *config) {
+	isMedia := n.Data != "source" || (n.Parent != nil && (n.Parent.Data == "video" || n.Parent.Data == "audio"))
+	embedded := false
+	for i, a := range n.Attr {
+		switch a.Key {
+		case "poster":
+			if n.Data != "video" || cfg.SkipImages {
+				continue
+			}
+			if dataURL, ok := imageDataURL(a.Val, cfg); ok {
+				n.Attr[i].Val = dataURL
+			}
+		case "src":
+			src := cfg.rewriteRef(a.Val)
+			if !isMedia || !cfg.EmbedMedia || !canEmbed(src, ResourceMedia, cfg) {
+				continue
+			}
+			if dataURL, ok := assetDataURL(src, ResourceMedia, mediaMimeTypes, cfg); ok {
+				n.Attr[i].Val = dataURL
+				embedded = true
+			}
+		}
+	}
+	if embedded {
+		removeFetchAttributes(n)
+	}
+}
+
+// embedObject embeds the image or audio/video file referenced by an <object
+// data> or <embed src> element, following the same rules as <img> and
+// <video>. Other resources, such as PDFs, are left external.
+func embedObject(n *html.Node, cfg *config) {
+	key := "src"
+	if n.Data == "object" {
+		key = "data"
+	}
+	for i, a := range n.Attr {
+		if a.Key != key {
+			continue
+		}
+
+		ref := cfg.rewriteRef(a.Val)
+		kind, mimeTypes := objectType(ref, getAttr(n, "type"), cfg)
+		switch {
+		case kind == "",
+			kind == ResourceImage && cfg.SkipImages,
+			kind == ResourceMedia && !cfg.EmbedMedia,
+			!canEmbed(ref, kind, cfg):
+			return
+		}
+		if dataURL, ok := assetDataURL(ref, kind, mimeTypes, cfg); ok {
+			n.Attr[i].Val = dataURL
+		}
+		return
+	}
+}
+
+// objectType returns the kind of resource an <object> or <embed> element
+// references along with the MIME types to encode it with, going by its
+// extension or else its type attribute. The kind is "" for resources that
+// aren't embedded.
+func objectType(ref, typeAttr string, cfg *config) (string, map[string]string) {
+	ext := refExt(ref)
+	typeAttr = strings.ToLower(strings.TrimSpace(typeAttr))
+	switch {
+	case cfg.imageTypes[ext] != "":
+		return ResourceImage, cfg.imageTypes
+	case mediaMimeTypes[ext] != "":
+		return ResourceMedia, mediaMimeTypes
+	case strings.HasPrefix(typeAttr, "image/"):
+		return ResourceImage, map[string]string{ext: typeAttr}
+	case strings.HasPrefix(typeAttr, "video/"), strings.HasPrefix(typeAttr, "audio/"):
+		return ResourceMedia, map[string]string{ext: typeAttr}
+	}
+	return "", nil
+}
+
+// srcsetCandidate is an image candidate of a srcset attribute
+type srcsetCandidate struct {
+	url        string
+	descriptor string // width or density descriptor, e.g. "2x", may be empty
+}
+
+// embedSrcset rewrites each candidate URL of a srcset attribute value,
+// keeping the width/density descriptors as they are.
+func embedSrcset(srcset string, cfg *config) string {
+	candidates := parseSrcset(srcset)
+	parts := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		if dataURL, ok := imageDataURL(candidate.url, cfg); ok {
+			candidate.url = dataURL
+		}
+		parts[i] = candidate.url
+		if candidate.descriptor != "" {
+			parts[i] += " " + candidate.descriptor
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseSrcset splits a srcset attribute value into its candidates, following
+// the HTML parsing rules: URLs may contain commas (as data URLs do), so only
+// commas after whitespace or at the end of a URL separate candidates.
+func parseSrcset(srcset string) []srcsetCandidate {
+	var candidates []srcsetCandidate
+	isSpace := func(c byte) bool {
+		return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+	}
+
+	for i := 0; i < len(srcset); {
+		// Skip whitespace and separating commas
+		if isSpace(srcset[i]) || srcset[i] == ',' {
+			i++
+			continue
+		}
+
+		// The URL runs until the next whitespace
+		start := i
+		for i < len(srcset) && !isSpace(srcset[i]) {
+			i++
+		}
+		url := srcset[start:i]
+
+		// Trailing commas end the candidate without descriptors
+		if strings.HasSuffix(url, ",") {
+			candidates = append(candidates, srcsetCandidate{url: strings.TrimRight(url, ",")})
+			continue
+		}
+
+		// Descriptors run until a comma outside of parentheses
+		start = i
+		depth := 0
+		for ; i < len(srcset); i++ {
+			if srcset[i] == '(' {
+				depth++
+			} else if srcset[i] == ')' && depth > 0 {
+				depth--
+			} else if srcset[i] == ',' && depth == 0 {
+				break
+			}
+		}
+		candidates = append(candidates, srcsetCandidate{
+			url:        url,
+			descriptor: strings.Join(strings.Fields(srcset[start:i]), " "),
+		})
+	}
+	return candidates
+}
+
+// imageDataURL returns the data URL for an image reference, or false if the
+// reference should be left untouched.
+func imageDataURL(src string, cfg *config) (string, bool) {
+	src = cfg.rewriteRef(src)
+	if !canEmbed(src, ResourceImage, cfg) {
+		return "", false
+	}
+	return assetDataURL(src, ResourceImage, cfg.imageTypes, cfg)
+}
+
+// shouldEmbed reports whether an asset reference points to something we can
+// embed: a relative path, a rooted path under the public prefix, or a remote
+// URL when fetching is enabled.
+func shouldEmbed(ref string, cfg *config) bool {
+	return externalReason(ref, cfg) == ""
+}
+
+// isDataURL reports whether ref is a data: URL, whose content is already
+// embedded
+func isDataURL(ref string) bool {
+	return hasURLPrefix(ref, "data:")
+}
+
+// externalReason explains why the asset referenced by ref is left external,
+// or returns "" when it can be embedded
+func externalReason(ref string, cfg *config) string {
+	switch {
+	case isRemote(ref):
+		if !cfg.FetchRemote {
+			return "remote fetching disabled"
+		}
+	case ref == "" || strings.HasPrefix(ref, "#") || strings.HasPrefix(ref, "?"):
+		return "not a file reference"
+	case strings.HasPrefix(ref, "//"):
+		return "protocol-relative URL"
+	case hasScheme(ref):
+		return "not a file reference"
+	case strings.HasPrefix(ref, "/") && !strings.HasPrefix(ref, cfg.PublicPrefix):
+		return "not under " + cfg.PublicPrefix
+	}
+	if pattern := excludedBy(ref, cfg); pattern != "" {
+		return "excluded by " + pattern
+	}
+	return ""
+}
+
+// excludedBy returns the Exclude pattern matching ref, or "" if there's none.
+// Patterns are matched against the reference, the path it resolves to and,
+// for patterns without a slash, the file name.
+func excludedBy(ref string, cfg *config) string {
+	return matchPattern(ref, cfg.Exclude, cfg)
+}
+
+// matchPattern returns the first of patterns matching ref as Exclude patterns
+// do, or "" if there's none
+func matchPattern(ref string, patterns []string, cfg *config) string {
+	resolved := resolvePath(ref, cfg)
+	for _, pattern := range patterns {
+		candidates := []string{stripQuery(ref), filepath.ToSlash(resolved)}
+		if !strings.Contains(pattern, "/") {
+			candidates = append(candidates, path.Base(stripQuery(ref)))
+		}
+		for _, candidate := range candidates {
+			if matched, _ := path.Match(pattern, candidate); matched {
+				return pattern
+			}
+		}
+	}
+	return ""
+}
+
+// canEmbed is shouldEmbed for references found in the document, recording
+// the ones that will be left external in the report
+func canEmbed(ref, kind string, cfg *config) bool {
+	// Already embedded, e.g. when knitting a file a second time
+	if isDataURL(ref) {
+		return false
+	}
+
+	reason := externalReason(ref, cfg)
+	if reason == "" {
+		return true
+	}
+	cfg.recordExternal(kind, ref, reason)
+	return false
+}
+
+// assetDataURL loads the asset referenced by ref and encodes it as a data URL.
+// Problems are logged as warnings of the given kind and reported by returning
+// false.
+func assetDataURL(ref, kind string, mimeTypes map[string]string, cfg *config) (string, bool) {
+	dataURL, mimeType, size, err := encodeAsset(ref, mimeTypes, cfg.embedLimit(kind), cfg)
+	if errors.Is(err, errTooLarge) {
+		cfg.debugf("Not embedding %s %s: %d bytes is over the %d bytes limit", kind, resolvePath(ref, cfg), size, cfg.embedLimit(kind))
+		cfg.recordExternal(kind, ref, err.Error())
+		return "", false
+	}
+	if err != nil {
+		cfg.unreadablef(ref, err, "Could not read %s file %s: %v", kind, resolvePath(ref, cfg), err)
+		cfg.recordExternal(kind, ref, err.Error())
+		return "", false
+	}
+	if mimeType == "" {
+		if isRemote(ref) {
+			cfg.warnf("Unknown %s type for %s", kind, ref)
+		} else {
+			extensions := slices.Sorted(maps.Keys(mimeTypes))
+			cfg.warnf("Unknown %s type %s for %s (supported: %s)", kind, refExt(ref), ref, strings.Join(extensions, ", "))
+		}
+		cfg.recordExternal(kind, ref, "unknown "+kind+" type")
+		return "", false
+	}
+
+	switch kind {
+	case ResourceFont:
+		cfg.report.FontsEmbedded++
+	case ResourceImage:
+		cfg.report.ImagesEmbedded++
+	case ResourceMedia:
+		cfg.report.MediaEmbedded++
+	}
+	cfg.recordEmbedded(kind, ref, mimeType, size)
+	return dataURL, true
+}
+
+// embedLimit returns the size limit for embedding assets of the given kind, 0
+// for none
+func (cfg *config) embedLimit(kind string) int64 {
+	if kind == ResourceMedia && cfg.MaxEmbedSize <= 0 {
+		return defaultMaxMediaSize
+	}
+	return cfg.MaxEmbedSize
+}
+
+// encodeAsset loads the asset referenced by ref and encodes it as a data URL.
+// The MIME type is looked up by extension in mimeTypes, falling back to the
+// Content-Type of remote responses. An empty MIME type is returned when it
+// can't be determined. size is the size of the asset in bytes. Assets over
+// limit bytes (unless it's 0) fail with errTooLarge.
+func encodeAsset(ref string, mimeTypes map[string]string, limit int64, cfg *config) (dataURL, mimeType string, size int, err error) {
+	mimeType, known := mimeTypes[refExt(ref)]
+	if !known && !isRemote(ref) {
+		return "", "", 0, nil
+	}
+
+	res, err := loadResource(ref, cfg)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if limit > 0 && int64(len(res.data)) > limit {
+		return "", "", len(res.data), errTooLarge
+	}
+
+	if !known {
+		if res.mimeType == "" {
+			return "", "", len(res.data), nil
+		}
+		mimeType = res.mimeType
+	}
+	return cfg.dataURL(mimeType, res), mimeType, len(res.data), nil
+}
+
+// assetRef is a reference to an asset along with the MIME types it may have
+type assetRef struct {
+	ref       string
+	mimeTypes map[string]string
+}
+
+// prefetchAssets loads and encodes assets using a pool of workers, so the
+// replacements that follow are served from the cache. Problems are left for
+// those replacements to report.
+func prefetchAssets(assets []assetRef, cfg *config) {
+	if cfg.Concurrency < 2 || len(assets) < 2 {
+		return
+	}
+
+	jobs := make(chan assetRef)
+	var wg sync.WaitGroup
+	for range min(cfg.Concurrency, len(assets)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for asset := range jobs {
+				if cfg.ctx.Err() == nil {
+					encodeAsset(asset.ref, asset.mimeTypes, cfg.MaxEmbedSize, cfg)
+				}
+			}
+		}()
+	}
+
+	for _, asset := range assets {
+		jobs <- asset
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// encodeDataURL encodes content as a data URL. SVG markup is percent-encoded
+// when that's shorter than base64, which it usually is. Everything else is
+// base64 encoded, straight into a buffer of the final size so large fonts
+// don't get copied around.
+func encodeDataURL(mimeType string, content []byte) string {
+	b64Len := base64.StdEncoding.EncodedLen(len(content))
+	if mimeType == "image/svg+xml" && utf8.Valid(content) {
+		if escaped := escapeDataURL(content); len(escaped) < b64Len+len(";base64") {
+			return "data:" + mimeType + "," + escaped
+		}
+	}
+
+	var b strings.Builder
+	b.Grow(len("data:") + len(mimeType) + len(";base64,") + b64Len)
+	b.WriteString("data:")
+	b.WriteString(mimeType)
+	b.WriteString(";base64,")
+	enc := base64.NewEncoder(base64.StdEncoding, &b)
+	enc.Write(content)
+	enc.Close() // flushes the last partial block, writes to b can't fail
+	return b.String()
+}
+
+// escapeDataURL percent-encodes content for use as the data of a data URL.
+// Besides control and non-ASCII characters, % and # (which would end the
+// data), it escapes the characters that would end the URL early in a srcset
+// or an unquoted CSS url(): spaces, quotes, parentheses and backslashes.
+// < and > are escaped too, as an SVG holding a </style> or </script> would
+// otherwise end the element its data URL gets inlined into.
+func escapeDataURL(content []byte) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	b.Grow(len(content))
+	for _, c := range content {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`%#"'()\<>`, c) >= 0 {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,88 @@
+package htmlknitter
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestEncodeDataURLSVG(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0,0,24,24"><path fill="#f00" d="M12,2C6.48,2,2,6.48,2,12s4.48,10,10,10,10-4.48,10-10S17.52,2,12,2zm0,18c-4.41,0-8-3.59-8-8s3.59-8,8-8,8,3.59,8,8-3.59,8-8,8z"/><text x='1'>100% (\o/)</text></svg>`
+	got := encodeDataURL("image/svg+xml", []byte(svg))
+
+	data, ok := strings.CutPrefix(got, "data:image/svg+xml,")
+	if !ok {
+		t.Fatalf("SVG not percent-encoded: %s", got)
+	}
+	for _, escaped := range []string{"%3Csvg", "%23f00", "100%25", "%20", "%22", "%27", "%28", "%29", "%5C", "%3E"} {
+		if !strings.Contains(data, escaped) {
+			t.Errorf("%s missing from %s", escaped, data)
+		}
+	}
+	if strings.ContainsAny(data, "# \"'()\\<>") {
+		t.Errorf("unescaped characters left in %s", data)
+	}
+	if decoded, err := url.PathUnescape(data); err != nil || decoded != svg {
+		t.Errorf("%s decodes to %q (%v), want %q", data, decoded, err, svg)
+	}
+}
+
+func TestSVGStyleBackground(t *testing.T) {
+	fsys := fstest.MapFS{
+		"bg.svg":  {Data: []byte(`<svg xmlns="http://www.w3.org/2000/svg"><style>rect{fill:red}</style><rect width="10" height="10"/></svg>`)},
+		"app.css": {Data: []byte(`.hero{background:url(bg.svg)}`)},
+	}
+	input := `<html><head><link rel="stylesheet" href="app.css"><style>.logo{background:url(bg.svg)}</style></head><body></body></html>`
+	got := knitString(t, fsys, input, Options{})
+
+	if n := strings.Count(got, "data:image/svg+xml,"); n != 2 {
+		t.Errorf("SVG embedded %d times, want 2:\n%s", n, got)
+	}
+	// Only the two <style> elements themselves may close one
+	if n := strings.Count(got, "</style>"); n != 2 {
+		t.Errorf("</style> found %d times, want 2:\n%s", n, got)
+	}
+}
+
+func TestEncodeDataURLBase64(t *testing.T) {
+	tests := []struct {
+		mimeType, content, want string
+	}{
+		{"font/woff2", "wOF2", "data:font/woff2;base64,d09GMg=="},
+		{"image/png", "\x89PNG", "data:image/png;base64,iVBORw=="},
+		// Not UTF-8, so it can't be percent-encoded as text
+		{"image/svg+xml", "\xff\xfe<svg/>", "data:image/svg+xml;base64,//48c3ZnLz4="},
+	}
+	for _, tt := range tests {
+		if got := encodeDataURL(tt.mimeType, []byte(tt.content)); got != tt.want {
+			t.Errorf("encodeDataURL(%s, %q) = %s, want %s", tt.mimeType, tt.content, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkEncodeDataURL(b *testing.B) {
+	font := assetData("fonts/large.woff2", 4<<20)
+	b.Run("encodeDataURL", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			encodeDataURL("font/woff2", font)
+		}
+	})
+	// What encodeDataURL saves: the encoded copy concatenated into another
+	b.Run("EncodeToString", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			_ = "data:font/woff2;base64," + base64.StdEncoding.EncodeToString(font)
+		}
+	})
+}
+
+func BenchmarkLargeFontsPage(b *testing.B) {
+	fsys, input := assetPage(36, 0, 1<<20)
+	b.ReportAllocs()
+	for range b.N {
+		benchKnit(b, fsys, input, Options{})
+	}
+}
@@ -0,0 +1,67 @@
+package htmlknitter
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/andybalholm/brotli"
+)
+
+// gzipBytes compresses data with gzip at the given level, 0 meaning the
+// default level
+func gzipBytes(data []byte, level int) ([]byte, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// brotliBytes compresses data with brotli at the given level, 0 meaning the
+// default level
+func brotliBytes(data []byte, level int) ([]byte, error) {
+	if level == 0 {
+		level = brotli.DefaultCompression
+	}
+	if level < brotli.BestSpeed || level > brotli.BestCompression {
+		return nil, fmt.Errorf("invalid brotli compression level %d", level)
+	}
+
+	var buf bytes.Buffer
+	w := brotli.NewWriterLevel(&buf, level)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Magic bytes gzip streams start with
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// maybeGunzip returns a reader of the decompressed content of r when it's
+// gzip-compressed, or a reader of r as is otherwise
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(gzipMagic))
+	if !bytes.Equal(magic, gzipMagic) {
+		return br, nil
+	}
+	return gzip.NewReader(br)
+}
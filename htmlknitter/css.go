@@ -0,0 +1,537 @@
+package htmlknitter
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Regular expressions to find font face rules, URLs and imports
+var (
+	fontFaceRegex = regexp.MustCompile(`@font-face\s*{[^}]*}`)
+	cssURLRegex   = regexp.MustCompile(`url\(\s*['"]?([^'"()]+?)['"]?\s*\)`)
+	importRegex   = regexp.MustCompile(`@import\s+(?:url\(\s*['"]?([^'"()]+?)['"]?\s*\)|['"]([^'"]+)['"])\s*([^;]*);`)
+	fontSrcRegex  = regexp.MustCompile(`(src\s*:\s*)([^;}]+)`)
+	urlVarRegex   = regexp.MustCompile(`(--[\w-]+)\s*:\s*(url\([^()]*\))\s*[;}]`)
+	varRegex      = regexp.MustCompile(`var\(\s*(--[\w-]+)\s*(?:,[^()]*)?\)`)
+	formatRegex   = regexp.MustCompile(`format\(\s*['"]?([\w-]+)['"]?\s*\)`)
+)
+
+// Font MIME types by @font-face format() hint
+var fontFormatTypes = map[string]string{
+	"woff2":             "font/woff2",
+	"woff":              "font/woff",
+	"truetype":          "font/ttf",
+	"opentype":          "font/otf",
+	"embedded-opentype": "application/vnd.ms-fontobject",
+	"collection":        "font/collection",
+}
+
+func embedCSS(n *html.Node, cfg *config) {
+	var href, media, nonce string
+	for _, a := range n.Attr {
+		switch a.Key {
+		case "href":
+			href = cfg.rewriteRef(a.Val)
+		case "media":
+			media = a.Val
+		case "nonce":
+			nonce = a.Val
+		}
+	}
+	if cfg.Nonce != "" {
+		nonce = cfg.Nonce
+	}
+
+	if href == "" || isDataURL(href) {
+		return
+	}
+	if cfg.SkipCSS {
+		cfg.recordExternal(ResourceCSS, href, "stylesheet inlining disabled")
+		return
+	}
+	if !canEmbed(href, ResourceCSS, cfg) {
+		return
+	}
+
+	// A stylesheet linked again with the same media applies already
+	key := normalizeRef(href, cfg) + " " + media
+	if cfg.stylesheets[key] {
+		cfg.debugf("Removing duplicate stylesheet %s", resolvePath(href, cfg))
+		n.Parent.RemoveChild(n)
+		return
+	}
+
+	// Read CSS file along with its imports
+	cssString, err := loadStylesheet(href, cfg, nil)
+	if err != nil {
+		cfg.unreadablef(href, err, "Could not read CSS file %s: %v", resolvePath(href, cfg), err)
+		return
+	}
+
+	// Minify CSS once all URLs have been replaced
+	if cfg.MinifyCSS {
+		cssString = minifyCSS(cssString)
+	}
+
+	// Create new style node. Unlike inlined scripts, which are changed in
+	// place, the <link> is replaced and only its media and nonce attributes
+	// carry over.
+	styleNode := &html.Node{
+		Type: html.ElementNode,
+		Data: "style",
+		Attr: []html.Attribute{
+			{Key: "type", Val: "text/css"},
+		},
+	}
+
+	// Keep conditional stylesheets (e.g. media="print") scoped
+	if media != "" {
+		styleNode.Attr = append(styleNode.Attr, html.Attribute{Key: "media", Val: media})
+	}
+
+	// Let the inlined CSS through a Content-Security-Policy
+	if nonce != "" {
+		styleNode.Attr = append(styleNode.Attr, html.Attribute{Key: "nonce", Val: nonce})
+	}
+
+	// Add CSS content
+	styleNode.AppendChild(&html.Node{
+		Type: html.TextNode,
+		Data: cssString,
+	})
+
+	// Replace link node with style node
+	n.Parent.InsertBefore(styleNode, n)
+	n.Parent.RemoveChild(n)
+	cfg.report.StylesheetsInlined++
+	cfg.stylesheets[key] = true
+}
+
+// loadStylesheet reads the stylesheet referenced by ref and returns its
+// content with fonts and images embedded and @import rules inlined. chain
+// holds the stylesheets currently being loaded, so import cycles are broken.
+func loadStylesheet(ref string, cfg *config, chain []string) (string, error) {
+	css, err := loadResource(ref, cfg)
+	if err != nil {
+		cfg.recordExternal(ResourceCSS, ref, err.Error())
+		return "", err
+	}
+	cfg.recordEmbedded(ResourceCSS, ref, "text/css", len(css.data))
+
+	// Catch truncated or corrupt stylesheets before they break the output
+	if cfg.Strict {
+		if err := validateCSS(string(css.data)); err != nil {
+			cfg.warnf("Malformed CSS in %s: %v", resolvePath(ref, cfg), err)
+		}
+	}
+
+	cssString := embedCSSAssets(string(css.data), ref, cfg)
+
+	chain = append(chain, resolvePath(ref, cfg))
+	return inlineImports(cssString, ref, cfg, chain), nil
+}
+
+// inlineImports replaces the @import rules of the stylesheet at parent with
+// the imported stylesheets. Relative imports are resolved against parent, or
+// against the document when it's empty.
+func inlineImports(cssString, parent string, cfg *config, chain []string) string {
+	// Spare a copy of stylesheets without imports, which can be large
+	if !importRegex.MatchString(cssString) {
+		return cssString
+	}
+	return importRegex.ReplaceAllStringFunc(cssString, func(rule string) string {
+		m := importRegex.FindStringSubmatch(rule)
+		importRef := m[1]
+		if importRef == "" {
+			importRef = m[2]
+		}
+		importRef = resolveCSSRef(cfg.rewriteRef(importRef), parent)
+		if !canEmbed(importRef, ResourceCSS, cfg) {
+			return rule
+		}
+
+		// Imports of a stylesheet being loaded would loop forever
+		if i := slices.Index(chain, resolvePath(importRef, cfg)); i >= 0 {
+			cycle := append(slices.Clone(chain[i:]), chain[i])
+			cfg.warnf("Skipping cyclic CSS import: %s", strings.Join(cycle, " -> "))
+			cfg.recordExternal(ResourceCSS, importRef, "cyclic import")
+			return ""
+		}
+
+		imported, err := loadStylesheet(importRef, cfg, chain)
+		if err != nil {
+			cfg.unreadablef(importRef, err, "Could not read CSS file %s: %v", resolvePath(importRef, cfg), err)
+			return rule
+		}
+
+		// Keep the media query the import was scoped to
+		if media := strings.TrimSpace(m[3]); media != "" {
+			return fmt.Sprintf("@media %s {\n%s\n}", media, imported)
+		}
+		return imported
+	})
+}
+
+// processCSSText embeds the fonts and images referenced by CSS that is part
+// of the document, such as a style attribute
+func processCSSText(css string, cfg *config) string {
+	return embedCSSAssets(css, "", cfg)
+}
+
+// processStyleText is processCSSText for the content of a <style> element,
+// which also gets its @import rules inlined unless stylesheets are left
+// external
+func processStyleText(css string, cfg *config) string {
+	css = processCSSText(css, cfg)
+	if cfg.SkipCSS {
+		return css
+	}
+	return inlineImports(css, "", cfg, nil)
+}
+
+// embedCSSAssets replaces the font and image references of the stylesheet at
+// parent with data URLs. Relative references are resolved against parent,
+// or against the document when it's empty.
+func embedCSSAssets(cssString, parent string, cfg *config) string {
+	// Load the referenced assets up front, concurrently
+	cssString = resolveFontFaceVars(cssString)
+	fontFaces := fontFaceRegex.FindAllString(cssString, -1)
+	if cfg.PruneUnusedFonts {
+		cssString, fontFaces = pruneUnusedFonts(cssString, fontFaces, cfg)
+	}
+	if cfg.PreferWOFF2 {
+		for i, fontFace := range fontFaces {
+			pruned := preferWOFF2(fontFace)
+			cssString = strings.Replace(cssString, fontFace, pruned, 1)
+			fontFaces[i] = pruned
+		}
+	}
+	prefetchAssets(cssAssets(cssString, fontFaces, parent, cfg), cfg)
+
+	// Embed the fonts of font face rules, then the images referenced
+	// anywhere else (e.g. background-image). The CSS is put together once
+	// done, in a single allocation as data URLs make it large.
+	faces := fontFaceRegex.FindAllStringIndex(cssString, -1)
+	fonts := make(map[string]string)
+	var repls []cssReplacement
+	for _, face := range faces {
+		repls = append(repls, embedFontFace(cssString, face, parent, fonts, cfg)...)
+	}
+	repls = append(repls, embedCSSImages(cssString, faces, parent, fonts, cfg)...)
+	return replaceCSS(cssString, repls)
+}
+
+// cssReplacement replaces css[start:end] with text
+type cssReplacement struct {
+	start, end int
+	text       string
+}
+
+// replaceCSS applies the replacements repls to css
+func replaceCSS(css string, repls []cssReplacement) string {
+	if len(repls) == 0 {
+		return css
+	}
+	slices.SortFunc(repls, func(a, b cssReplacement) int { return a.start - b.start })
+	size := len(css)
+	for _, r := range repls {
+		size += len(r.text) - (r.end - r.start)
+	}
+	var b strings.Builder
+	b.Grow(size)
+	last := 0
+	for _, r := range repls {
+		b.WriteString(css[last:r.start])
+		b.WriteString(r.text)
+		last = r.end
+	}
+	b.WriteString(css[last:])
+	return b.String()
+}
+
+// embedFontFace returns the replacements of the font URLs of the @font-face
+// rule at css[face[0]:face[1]] with data URLs, unless fonts are left
+// external. The url() values replaced are added to fonts along with their
+// data URL.
+func embedFontFace(css string, face []int, parent string, fonts map[string]string, cfg *config) []cssReplacement {
+	if cfg.SkipFonts {
+		return nil
+	}
+	fontFace := css[face[0]:face[1]]
+	formats := fontFormats(fontFace)
+	var repls []cssReplacement
+	for _, m := range cssURLRegex.FindAllStringSubmatchIndex(fontFace, -1) {
+		url := fontFace[m[2]:m[3]]
+		fontPath := resolveCSSRef(cfg.rewriteRef(url), parent)
+		if !canEmbed(fontPath, ResourceFont, cfg) {
+			continue
+		}
+		dataURL, ok := assetDataURL(fontPath, ResourceFont, fontTypesFor(fontPath, formats[url], cfg), cfg)
+		if !ok {
+			continue
+		}
+		fonts[fontFace[m[0]:m[1]]] = dataURL
+		repls = append(repls, cssReplacement{face[0] + m[2], face[0] + m[3], dataURL})
+	}
+	return repls
+}
+
+// embedCSSImages returns the replacements of the image URLs of css outside
+// of the @font-face rules at faces with data URLs, unless images are left
+// external. The url() values of embedded fonts, e.g. in a custom property a
+// @font-face rule used, get the data URL of the font.
+func embedCSSImages(css string, faces [][]int, parent string, fonts map[string]string, cfg *config) []cssReplacement {
+	if cfg.SkipImages && len(fonts) == 0 {
+		return nil
+	}
+	var repls []cssReplacement
+	for _, m := range cssURLRegex.FindAllStringSubmatchIndex(css, -1) {
+		if slices.ContainsFunc(faces, func(face []int) bool { return m[0] >= face[0] && m[1] <= face[1] }) {
+			continue
+		}
+		if dataURL, ok := fonts[css[m[0]:m[1]]]; ok {
+			repls = append(repls, cssReplacement{m[2], m[3], dataURL})
+			continue
+		}
+		if cfg.SkipImages {
+			continue
+		}
+		imagePath := resolveCSSRef(cfg.rewriteRef(css[m[2]:m[3]]), parent)
+		if _, ok := cfg.imageTypes[refExt(imagePath)]; !ok {
+			// Not an image
+			continue
+		}
+		if !canEmbed(imagePath, ResourceImage, cfg) {
+			continue
+		}
+		dataURL, ok := assetDataURL(imagePath, ResourceImage, cfg.imageTypes, cfg)
+		if !ok {
+			continue
+		}
+		repls = append(repls, cssReplacement{m[2], m[3], dataURL})
+	}
+	return repls
+}
+
+// resolveFontFaceVars substitutes var(--name) references in @font-face rules
+// with the url() the custom property is declared as. Custom properties don't
+// apply to @font-face descriptors, and this way the font gets embedded. Only
+// properties declared with a single distinct url() are resolved, as there's
+// no cascade to pick between several.
+func resolveFontFaceVars(cssString string) string {
+	urls := make(map[string]string)
+	for _, m := range urlVarRegex.FindAllStringSubmatch(cssString, -1) {
+		if other, ok := urls[m[1]]; ok && other != m[2] {
+			urls[m[1]] = ""
+			continue
+		}
+		urls[m[1]] = m[2]
+	}
+	if len(urls) == 0 {
+		return cssString
+	}
+
+	return fontFaceRegex.ReplaceAllStringFunc(cssString, func(fontFace string) string {
+		return varRegex.ReplaceAllStringFunc(fontFace, func(ref string) string {
+			if url := urls[varRegex.FindStringSubmatch(ref)[1]]; url != "" {
+				return url
+			}
+			return ref
+		})
+	})
+}
+
+// validateCSS does a basic sanity check of a stylesheet: braces must be
+// balanced, and comments, strings and url() values terminated. This is far
+// from full validation, but catches truncated or corrupt files.
+func validateCSS(css string) error {
+	line := func(i int) int {
+		return strings.Count(css[:i], "\n") + 1
+	}
+
+	var open []int // offsets of the unclosed braces
+	for i := 0; i < len(css); i++ {
+		switch {
+		case strings.HasPrefix(css[i:], "/*"):
+			end := strings.Index(css[i+2:], "*/")
+			if end < 0 {
+				return fmt.Errorf("unterminated comment at line %d", line(i))
+			}
+			i += end + 3
+		case len(css)-i >= 4 && strings.EqualFold(css[i:i+4], "url("):
+			end := cssURLEnd(css, i+4)
+			if css[end-1] != ')' {
+				return fmt.Errorf("unterminated url( at line %d", line(i))
+			}
+			i = end - 1
+		case css[i] == '"' || css[i] == '\'':
+			end := cssStringEnd(css, i)
+			if end-1 == i || css[end-1] != css[i] {
+				return fmt.Errorf("unterminated string at line %d", line(i))
+			}
+			i = end - 1
+		case css[i] == '{':
+			open = append(open, i)
+		case css[i] == '}':
+			if len(open) == 0 {
+				return fmt.Errorf("unexpected } at line %d", line(i))
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	if len(open) > 0 {
+		return fmt.Errorf("unclosed { at line %d", line(open[len(open)-1]))
+	}
+	return nil
+}
+
+// cssAssets lists the distinct fonts and images referenced by the stylesheet
+// at parent that will be embedded
+func cssAssets(cssString string, fontFaces []string, parent string, cfg *config) []assetRef {
+	var assets []assetRef
+	seen := make(map[string]bool)
+	add := func(ref string, mimeTypes map[string]string) {
+		ref = resolveCSSRef(cfg.rewriteRef(ref), parent)
+		if !seen[ref] && shouldEmbed(ref, cfg) {
+			seen[ref] = true
+			assets = append(assets, assetRef{ref: ref, mimeTypes: mimeTypes})
+		}
+	}
+
+	if !cfg.SkipFonts {
+		for _, fontFace := range fontFaces {
+			formats := fontFormats(fontFace)
+			for _, match := range cssURLRegex.FindAllStringSubmatch(fontFace, -1) {
+				add(match[1], fontTypesFor(match[1], formats[match[1]], cfg))
+			}
+		}
+	}
+	if !cfg.SkipImages {
+		for _, match := range cssURLRegex.FindAllStringSubmatch(fontFaceRegex.ReplaceAllString(cssString, ""), -1) {
+			if _, ok := cfg.imageTypes[refExt(match[1])]; ok {
+				add(match[1], cfg.imageTypes)
+			}
+		}
+	}
+	return assets
+}
+
+// preferWOFF2 reduces the src descriptors of a @font-face rule to a single
+// font file: the woff2 one when present, the first one otherwise. local()
+// sources are kept since they cost nothing to embed.
+func preferWOFF2(fontFace string) string {
+	return fontSrcRegex.ReplaceAllStringFunc(fontFace, func(decl string) string {
+		m := fontSrcRegex.FindStringSubmatch(decl)
+		var local, files []string
+		for _, source := range splitCSSList(m[2]) {
+			if strings.HasPrefix(strings.ToLower(source), "local(") {
+				local = append(local, source)
+			} else {
+				files = append(files, source)
+			}
+		}
+		if len(files) < 2 {
+			return decl
+		}
+
+		chosen := files[0]
+		for _, source := range files {
+			if isWOFF2Source(source) {
+				chosen = source
+				break
+			}
+		}
+		return m[1] + strings.Join(append(local, chosen), ", ")
+	})
+}
+
+// fontFormats maps the url()s of the sources of a @font-face rule to the MIME
+// type given by their format() hint, e.g. format("woff2") to font/woff2
+func fontFormats(fontFace string) map[string]string {
+	formats := make(map[string]string)
+	for _, decl := range fontSrcRegex.FindAllStringSubmatch(fontFace, -1) {
+		for _, source := range splitCSSList(decl[2]) {
+			url := cssURLRegex.FindStringSubmatch(source)
+			format := formatRegex.FindStringSubmatch(source)
+			if url == nil || format == nil {
+				continue
+			}
+			if mimeType, ok := fontFormatTypes[strings.ToLower(format[1])]; ok {
+				formats[url[1]] = mimeType
+			}
+		}
+	}
+	return formats
+}
+
+// fontTypesFor returns the MIME types to embed the font at ref with: the
+// known font types, unless its extension isn't one of them (e.g. it has
+// none) and its format() hint gives its type
+func fontTypesFor(ref, formatType string, cfg *config) map[string]string {
+	ext := refExt(ref)
+	if _, known := cfg.fontTypes[ext]; known || formatType == "" {
+		return cfg.fontTypes
+	}
+	return map[string]string{ext: formatType}
+}
+
+// isWOFF2Source reports whether a @font-face source points to a woff2 file,
+// going by its format() hint or its extension
+func isWOFF2Source(source string) bool {
+	lower := strings.ToLower(source)
+	if strings.Contains(lower, "format(") {
+		return strings.Contains(lower, `format("woff2")`) || strings.Contains(lower, `format('woff2')`) || strings.Contains(lower, "format(woff2)")
+	}
+	match := cssURLRegex.FindStringSubmatch(source)
+	return match != nil && refExt(match[1]) == ".woff2"
+}
+
+// splitCSSList splits a comma-separated CSS value, ignoring commas inside
+// parentheses and strings
+func splitCSSList(value string) []string {
+	var items []string
+	depth, start := 0, 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '"', '\'':
+			i = cssStringEnd(value, i) - 1
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, strings.TrimSpace(value[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(items, strings.TrimSpace(value[start:]))
+}
+
+// resolveCSSRef resolves a url() or @import reference against the stylesheet
+// that contains it, as relative references in CSS are relative to the
+// stylesheet rather than the document
+func resolveCSSRef(ref, parent string) string {
+	if isRemote(ref) || hasScheme(ref) || strings.HasPrefix(ref, "/") || strings.HasPrefix(ref, "#") {
+		return ref
+	}
+	if isRemote(parent) {
+		base, err := url.Parse(parent)
+		if err != nil {
+			return ref
+		}
+		rel, err := url.Parse(ref)
+		if err != nil {
+			return ref
+		}
+		return base.ResolveReference(rel).String()
+	}
+	return filepath.Join(filepath.Dir(stripQuery(parent)), ref)
+}
@@ -0,0 +1,169 @@
+package htmlknitter
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCSSURLsRelativeToStylesheet(t *testing.T) {
+	fsys := fstest.MapFS{
+		"_next/static/css/app.css": {Data: []byte(`@import "nested/more.css";
+@font-face{font-family:A;src:url(../media/a.woff2) format("woff2")}
+.hero{background:url(./img/bg.png)}
+.logo{background:url(/_next/static/logo.png)}`)},
+		"_next/static/css/nested/more.css": {Data: []byte(`@font-face{font-family:B;src:url(../../media/b.woff2) format("woff2")}`)},
+		"_next/static/css/img/bg.png":      {Data: []byte("bg")},
+		"_next/static/media/a.woff2":       {Data: []byte("font a")},
+		"_next/static/media/b.woff2":       {Data: []byte("font b")},
+		"_next/static/logo.png":            {Data: []byte("logo")},
+	}
+	tests := []struct {
+		name, inputFile, href string
+	}{
+		{"rooted link", "index.html", "/_next/static/css/app.css"},
+		{"relative link from a nested page", "blog/2024/post.html", "../../_next/static/css/app.css"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := `<html><head><link rel="stylesheet" href="` + tt.href + `"></head><body></body></html>`
+			got := knitString(t, fsys, input, Options{InputFile: tt.inputFile})
+			for _, want := range []string{
+				"data:font/woff2;base64," + b64("font a"),
+				"data:font/woff2;base64," + b64("font b"),
+				"data:image/png;base64," + b64("bg"),
+				"data:image/png;base64," + b64("logo"),
+			} {
+				if !strings.Contains(got, want) {
+					t.Errorf("output lacks %s:\n%s", want, got)
+				}
+			}
+			if strings.Contains(got, "<link") || strings.Contains(got, "@import") {
+				t.Errorf("stylesheet not fully inlined:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestStylesheetMediaPreserved(t *testing.T) {
+	fsys := fstest.MapFS{"narrow.css": {Data: []byte(`nav{display:none}`)}}
+	input := `<html><head><link rel="stylesheet" href="narrow.css" media="(max-width: 600px)"></head><body></body></html>`
+	got := knitString(t, fsys, input, Options{})
+	want := `<style type="text/css" media="(max-width: 600px)">nav{display:none}</style>`
+	if !strings.Contains(got, want) {
+		t.Errorf("output lacks %s:\n%s", want, got)
+	}
+}
+
+func TestVersionedFontURLs(t *testing.T) {
+	fsys := fstest.MapFS{
+		"_next/static/css/app.css": {Data: []byte(`@import url(extra.css?v=2);
+@font-face{font-family:A;src:url(/_next/static/media/a.woff2?v=abc) format("woff2")}
+@font-face{font-family:B;src:url("../media/b.eot?#iefix") format("embedded-opentype"),url(../media/b.woff#v1) format("woff")}`)},
+		"_next/static/css/extra.css": {Data: []byte(`.x{color:red}`)},
+		"_next/static/media/a.woff2": {Data: []byte("font a")},
+		"_next/static/media/b.eot":   {Data: []byte("font b eot")},
+		"_next/static/media/b.woff":  {Data: []byte("font b woff")},
+	}
+	input := `<html><head><link rel="stylesheet" href="/_next/static/css/app.css?build=42"></head><body></body></html>`
+	got := knitString(t, fsys, input, Options{})
+	for _, want := range []string{
+		".x{color:red}",
+		"data:font/woff2;base64," + b64("font a"),
+		"data:application/vnd.ms-fontobject;base64," + b64("font b eot"),
+		"data:font/woff;base64," + b64("font b woff"),
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output lacks %s:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "?v=") || strings.Contains(got, "<link") {
+		t.Errorf("versioned URLs left in output:\n%s", got)
+	}
+}
+
+func TestCyclicImports(t *testing.T) {
+	fsys := fstest.MapFS{
+		"css/a.css": {Data: []byte(`@import "b.css";
+.a{color:red}`)},
+		"css/b.css": {Data: []byte(`@import url(a.css);
+.b{color:blue}`)},
+	}
+	var logs bytes.Buffer
+	input := `<html><head><link rel="stylesheet" href="css/a.css"></head><body></body></html>`
+	got := knitString(t, fsys, input, Options{Logger: log.New(&logs, "", 0)})
+
+	for _, rule := range []string{".a{color:red}", ".b{color:blue}"} {
+		if n := strings.Count(got, rule); n != 1 {
+			t.Errorf("%s inlined %d times:\n%s", rule, n, got)
+		}
+	}
+	if strings.Contains(got, "@import") {
+		t.Errorf("cyclic import left in output:\n%s", got)
+	}
+	if want := "Skipping cyclic CSS import: css/a.css -> css/b.css -> css/a.css"; !strings.Contains(logs.String(), want) {
+		t.Errorf("warning %q not logged, got:\n%s", want, logs.String())
+	}
+}
+
+func TestDuplicateStylesheet(t *testing.T) {
+	fsys := fstest.MapFS{
+		"css/app.css": {Data: []byte(`@font-face{font-family:A;src:url(a.woff2)} body{font-family:A}`)},
+		"css/a.woff2": {Data: []byte("font a")},
+	}
+	input := `<html><head><link rel="stylesheet" href="css/app.css"></head>` +
+		`<body><p>x</p><link rel="stylesheet" href="./css/app.css"></body></html>`
+	got := knitString(t, fsys, input, Options{})
+
+	if n := strings.Count(got, "<style"); n != 1 {
+		t.Errorf("stylesheet inlined %d times:\n%s", n, got)
+	}
+	if n := strings.Count(got, b64("font a")); n != 1 {
+		t.Errorf("font embedded %d times:\n%s", n, got)
+	}
+	if strings.Contains(got, "<link") {
+		t.Errorf("duplicate <link> left in output:\n%s", got)
+	}
+}
+
+func TestStyleImportWithFontFace(t *testing.T) {
+	fsys := fstest.MapFS{
+		"_next/x.css":         {Data: []byte(`@font-face{font-family:X;src:url(media/x.woff2) format("woff2")} h1{font-family:X}`)},
+		"_next/media/x.woff2": {Data: []byte("font x")},
+		"_next/print.css":     {Data: []byte(`nav{display:none}`)},
+	}
+	input := `<html><head><style>@import url(/_next/x.css);
+@import "/_next/print.css" print;
+body{margin:0}</style></head><body><h1 style="color:red">x</h1></body></html>`
+	got := knitString(t, fsys, input, Options{})
+	for _, want := range []string{
+		`src:url(data:font/woff2;base64,` + b64("font x") + `) format("woff2")`,
+		"h1{font-family:X}",
+		"@media print {\nnav{display:none}\n}",
+		"body{margin:0}",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output lacks %s:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "@import") {
+		t.Errorf("@import left in output:\n%s", got)
+	}
+}
+
+func BenchmarkMultiFontPage(b *testing.B) {
+	fsys, input := assetPage(100, 0, 64<<10)
+	for _, concurrency := range slices.Compact([]int{1, runtime.GOMAXPROCS(0)}) {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for range b.N {
+				// A fresh cache each time, so every font is read and encoded
+				benchKnit(b, fsys, input, Options{Concurrency: concurrency})
+			}
+		})
+	}
+}
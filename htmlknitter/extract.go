@@ -0,0 +1,172 @@
+package htmlknitter
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// extractAssets replaces the data: URLs of the document with references to
+// files in cfg.ExtractAssets, named after a hash of their content. The files
+// to write are collected in cfg.extracted by name.
+func extractAssets(n *html.Node, cfg *config) {
+	if n.Type == html.ElementNode {
+		for i, a := range n.Attr {
+			switch a.Key {
+			case "src", "href", "poster", "data":
+				n.Attr[i].Val = extractDataURL(a.Val, cfg)
+			case "srcset":
+				candidates := parseSrcset(a.Val)
+				parts := make([]string, len(candidates))
+				for j, candidate := range candidates {
+					parts[j] = extractDataURL(candidate.url, cfg)
+					if candidate.descriptor != "" {
+						parts[j] += " " + candidate.descriptor
+					}
+				}
+				n.Attr[i].Val = strings.Join(parts, ", ")
+			case "style":
+				n.Attr[i].Val = extractCSSDataURLs(a.Val, cfg)
+			}
+		}
+
+		if n.Data == "style" && n.FirstChild != nil && n.FirstChild.Type == html.TextNode {
+			n.FirstChild.Data = extractCSSDataURLs(n.FirstChild.Data, cfg)
+		}
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		extractAssets(c, cfg)
+	}
+}
+
+// extractCSSDataURLs replaces the data: URLs in the url()s of css
+func extractCSSDataURLs(css string, cfg *config) string {
+	return cssURLRegex.ReplaceAllStringFunc(css, func(match string) string {
+		ref := cssURLRegex.FindStringSubmatch(match)[1]
+		if !isDataURL(ref) {
+			return match
+		}
+		return "url(" + extractDataURL(ref, cfg) + ")"
+	})
+}
+
+// extractDataURL returns the reference to the file the content of a data URL
+// is extracted to, or ref unchanged if it isn't a data URL of a known type
+func extractDataURL(ref string, cfg *config) string {
+	if !isDataURL(ref) {
+		return ref
+	}
+
+	mimeType, data, err := decodeDataURL(ref)
+	if err != nil {
+		cfg.warnf("Could not decode data URL: %v", err)
+		return ref
+	}
+	ext := mimeTypeExt(mimeType, cfg)
+	if ext == "" {
+		cfg.debugf("Not extracting data URL of unknown type %q", mimeType)
+		return ref
+	}
+
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:8]) + ext
+	if _, ok := cfg.extracted[name]; !ok {
+		cfg.extracted[name] = data
+		cfg.report.AssetsExtracted++
+		cfg.debugf("Extracted %s (%d bytes)", name, len(data))
+	}
+	return path.Join(cfg.extractRef, name)
+}
+
+// decodeDataURL returns the MIME type and content of a base64 or
+// percent-encoded data URL
+func decodeDataURL(ref string) (mimeType string, data []byte, err error) {
+	header, content, found := strings.Cut(ref[len("data:"):], ",")
+	if !found {
+		return "", nil, fmt.Errorf("missing comma")
+	}
+
+	params := strings.Split(header, ";")
+	mimeType = strings.ToLower(strings.TrimSpace(params[0]))
+	if params[len(params)-1] == "base64" {
+		// Whitespace is allowed in base64 data URLs, e.g. when wrapped
+		content = strings.Join(strings.Fields(content), "")
+		data, err = base64.StdEncoding.DecodeString(content)
+		return mimeType, data, err
+	}
+
+	unescaped, err := url.PathUnescape(content)
+	return mimeType, []byte(unescaped), err
+}
+
+// mimeTypeExt returns the file extension for a font, image or media MIME
+// type, or "" if it's unknown. When several extensions share a type the
+// shortest one wins, e.g. .jpg over .jpeg.
+func mimeTypeExt(mimeType string, cfg *config) string {
+	best := ""
+	for _, types := range []map[string]string{cfg.fontTypes, cfg.imageTypes, mediaMimeTypes} {
+		for ext, t := range types {
+			if t != mimeType {
+				continue
+			}
+			if best == "" || len(ext) < len(best) || len(ext) == len(best) && ext < best {
+				best = ext
+			}
+		}
+	}
+	return best
+}
+
+// extractRef returns the URL of the ExtractAssets directory relative to the
+// output file
+func extractRef(cfg *config) (string, error) {
+	from := cfg.OutputFile
+	if from == "" {
+		from = cfg.InputFile
+	}
+	fromDir, err := filepath.Abs(filepath.Dir(from))
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.Abs(cfg.ExtractAssets)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(fromDir, dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// writeExtracted writes the extracted assets to the ExtractAssets directory,
+// skipping the ones already there from earlier runs
+func writeExtracted(cfg *config) error {
+	if len(cfg.extracted) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(cfg.ExtractAssets, 0755); err != nil {
+		return &Error{Op: "creating assets directory", Path: cfg.ExtractAssets, Err: err}
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.extracted)) {
+		path := filepath.Join(cfg.ExtractAssets, name)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := writeOutput(path, cfg.extracted[name], 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package htmlknitter
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Regular expressions to find references to ids: url(#id) in attributes and
+// CSS declarations, and #id in CSS selectors
+var (
+	urlIDRegex = regexp.MustCompile(`url\(\s*(['"]?)#([^'"()\s]+)`)
+	cssIDRegex = regexp.MustCompile(`#(-?[A-Za-z_][\w-]*)`)
+)
+
+// Attributes holding a space-separated list of ids
+var idListAttributes = map[string]bool{
+	"for": true, "form": true, "list": true, "headers": true, "itemref": true,
+	"aria-activedescendant": true, "aria-controls": true, "aria-describedby": true,
+	"aria-details": true, "aria-errormessage": true, "aria-flowto": true,
+	"aria-labelledby": true, "aria-owns": true,
+}
+
+// prefixIDs adds prefix to the id attributes of the document, along with the
+// references to them: #id links, id lists such as aria-labelledby, url(#id)
+// references (e.g. SVG gradients, filters and clip paths) and #id selectors
+// in <style> elements. References to ids the document doesn't have are left
+// alone.
+func prefixIDs(doc *html.Node, prefix string) {
+	ids := make(map[string]bool)
+	collectIDs(doc, ids)
+	if len(ids) > 0 {
+		prefixIDRefs(doc, prefix, ids)
+	}
+}
+
+// collectIDs adds the id attributes under n to ids
+func collectIDs(n *html.Node, ids map[string]bool) {
+	if n.Type == html.ElementNode {
+		if id := getAttr(n, "id"); id != "" {
+			ids[id] = true
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		collectIDs(c, ids)
+	}
+}
+
+// prefixIDRefs rewrites the ids under n and the references to them
+func prefixIDRefs(n *html.Node, prefix string, ids map[string]bool) {
+	switch n.Type {
+	case html.ElementNode:
+		for i, a := range n.Attr {
+			switch {
+			case a.Key == "id" && ids[a.Val]:
+				n.Attr[i].Val = prefix + a.Val
+			case a.Key == "href" && strings.HasPrefix(a.Val, "#") && ids[a.Val[1:]]:
+				n.Attr[i].Val = "#" + prefix + a.Val[1:]
+			case idListAttributes[a.Key]:
+				refs := strings.Fields(a.Val)
+				for j, ref := range refs {
+					if ids[ref] {
+						refs[j] = prefix + ref
+					}
+				}
+				n.Attr[i].Val = strings.Join(refs, " ")
+			case strings.Contains(a.Val, "url("):
+				n.Attr[i].Val = prefixURLIDs(a.Val, prefix, ids)
+			}
+		}
+	case html.TextNode:
+		if n.Parent != nil && n.Parent.Data == "style" {
+			n.Data = prefixCSSIDs(n.Data, prefix, ids)
+		}
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		prefixIDRefs(c, prefix, ids)
+	}
+}
+
+// prefixURLIDs rewrites the url(#id) references of val
+func prefixURLIDs(val, prefix string, ids map[string]bool) string {
+	return urlIDRegex.ReplaceAllStringFunc(val, func(ref string) string {
+		m := urlIDRegex.FindStringSubmatch(ref)
+		if !ids[m[2]] {
+			return ref
+		}
+		return "url(" + m[1] + "#" + prefix + m[2]
+	})
+}
+
+// prefixCSSIDs rewrites the #id selectors and url(#id) references of css.
+// The text before a { is a selector, while the text before a ; or } is a
+// declaration, where #name may be a color such as #ace and only url(#id)
+// gets rewritten. Strings and comments are skipped when looking for those
+// delimiters.
+func prefixCSSIDs(css, prefix string, ids map[string]bool) string {
+	var b strings.Builder
+	start := 0
+	for i := 0; i < len(css); i++ {
+		switch c := css[i]; c {
+		case '"', '\'':
+			for i++; i < len(css) && css[i] != c; i++ {
+				if css[i] == '\\' {
+					i++
+				}
+			}
+		case '/':
+			if strings.HasPrefix(css[i:], "/*") {
+				end := strings.Index(css[i+2:], "*/")
+				if end < 0 {
+					i = len(css)
+				} else {
+					i += end + 3
+				}
+			}
+		case '{', '}', ';':
+			if c == '{' {
+				b.WriteString(cssIDRegex.ReplaceAllStringFunc(css[start:i], func(ref string) string {
+					if !ids[ref[1:]] {
+						return ref
+					}
+					return "#" + prefix + ref[1:]
+				}))
+			} else {
+				b.WriteString(prefixURLIDs(css[start:i], prefix, ids))
+			}
+			b.WriteByte(c)
+			start = i + 1
+		}
+	}
+	if start < len(css) {
+		b.WriteString(prefixURLIDs(css[start:], prefix, ids))
+	}
+	return b.String()
+}
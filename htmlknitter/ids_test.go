@@ -0,0 +1,31 @@
+package htmlknitter
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestPrefixIDs(t *testing.T) {
+	input := `<html><head><style>#nav{color:#fff} #nav a, .x{fill:url(#grad)}</style></head><body>` +
+		`<nav id="nav" aria-labelledby="title other"><h2 id="title">T</h2><a href="#nav">top</a><a href="#missing">x</a></nav>` +
+		`<svg><linearGradient id="grad"></linearGradient><rect fill="url(#grad)"/></svg>` +
+		`<label for="name">Name</label><input id="name">` +
+		`</body></html>`
+	got := knitString(t, fstest.MapFS{}, input, Options{PrefixIDs: "w-"})
+
+	for _, want := range []string{
+		// Hex colors aren't ids
+		`#w-nav{color:#fff} #w-nav a, .x{fill:url(#w-grad)}`,
+		// Ids the document doesn't have are left alone
+		`<nav id="w-nav" aria-labelledby="w-title other">`,
+		`<h2 id="w-title">`,
+		`<a href="#w-nav">top</a><a href="#missing">x</a>`,
+		`<linearGradient id="w-grad"></linearGradient><rect fill="url(#w-grad)">`,
+		`<label for="w-name">Name</label><input id="w-name"/>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output lacks %s:\n%s", want, got)
+		}
+	}
+}
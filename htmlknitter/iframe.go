@@ -0,0 +1,85 @@
+package htmlknitter
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// embedIframe knits the local HTML file referenced by an <iframe src> into
+// its srcdoc attribute. The file is processed with the options of the
+// document, minus the ones that only apply to the top-level output.
+func embedIframe(n *html.Node, cfg *config) {
+	src := cfg.rewriteRef(getAttr(n, "src"))
+	// srcdoc takes precedence over src already
+	if src == "" || hasAttr(n, "srcdoc") || isDataURL(src) || strings.HasPrefix(src, "about:") {
+		return
+	}
+	if isRemote(src) {
+		cfg.recordExternal(ResourceDocument, src, "remote document")
+		return
+	}
+	if !canEmbed(src, ResourceDocument, cfg) {
+		return
+	}
+
+	path := normalizeRef(src, cfg)
+	chain := append(slices.Clone(cfg.iframes), filepath.Clean(cfg.InputFile))
+	if i := slices.Index(chain, path); i >= 0 {
+		cycle := append(chain[i:], path)
+		cfg.warnf("Skipping cyclic iframe: %s", strings.Join(cycle, " -> "))
+		cfg.recordExternal(ResourceDocument, src, "cyclic iframe")
+		return
+	}
+	if len(chain) > cfg.MaxIframeDepth {
+		cfg.warnf("Not inlining iframe %s: nested more than %d levels deep", path, cfg.MaxIframeDepth)
+		cfg.recordExternal(ResourceDocument, src, "nested too deep")
+		return
+	}
+
+	res, err := loadResource(src, cfg)
+	if err != nil {
+		cfg.unreadablef(src, err, "Could not read iframe document %s: %v", path, err)
+		cfg.recordExternal(ResourceDocument, src, err.Error())
+		return
+	}
+
+	// Options applying to the top-level document only
+	opts := cfg.Options
+	opts.InputFile = resolvePath(src, cfg)
+	opts.Streaming = false
+	opts.Fragment = false
+	opts.XHTML = false
+	opts.KeepElements = nil
+	opts.PrefixIDs = ""
+	opts.BaseHref = ""
+	opts.CommentBanner = ""
+	opts.Pretty = false
+	opts.MaxOutputSize = 0
+	child, err := newConfig(cfg.ctx, opts)
+	if err != nil {
+		cfg.warnf("Could not inline iframe %s: %v", path, err)
+		cfg.recordExternal(ResourceDocument, src, err.Error())
+		return
+	}
+
+	// Share the assets and extracted files of the document
+	child.client = cfg.client
+	child.assets = cfg.assets
+	child.extracted = cfg.extracted
+	child.extractRef = cfg.extractRef
+	child.iframes = chain
+	output, err := knitHTML(child, res.data)
+	if err != nil {
+		cfg.warnf("Could not inline iframe %s: %v", path, err)
+		cfg.recordExternal(ResourceDocument, src, err.Error())
+		return
+	}
+
+	cfg.report.add(child.report)
+	cfg.recordEmbedded(ResourceDocument, src, "text/html", len(res.data))
+	setAttr(n, "srcdoc", string(output))
+	removeAttr(n, "src")
+}
@@ -0,0 +1,863 @@
+// Package htmlknitter takes a HTML file and embeds the assets it references
+// (stylesheets, fonts, images, scripts) so the result is a single
+// self-contained HTML file.
+package htmlknitter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Options controls how a HTML file is knitted. Apart from the input and
+// output paths, the zero value is a sensible default: CSS, fonts and images
+// get embedded and JavaScript is left untouched.
+type Options struct {
+	// InputFile is the path of the HTML file to process (required)
+	InputFile string
+	// OutputFile is the path the processed HTML is written to (required
+	// unless DryRun is set)
+	OutputFile string
+	// DryRun processes the input without writing the output file
+	DryRun bool
+	// Fragment treats the input as a HTML snippet (e.g. a component) rather
+	// than a document, so no <html>, <head> or <body> wrappers get added
+	Fragment bool
+	// XHTML treats the input as XHTML: self-closing tags like <div/> are
+	// honored and the output is kept well-formed XML, with the <?xml ?>
+	// declaration preserved, the XHTML namespace declared and scripts and
+	// styles wrapped in CDATA sections where needed
+	XHTML bool
+	// BaseDir is the asset root rooted paths are resolved against: the
+	// leading slash is dropped and the path joined to BaseDir, so
+	// "/_next/static/app.css" becomes BaseDir/_next/static/app.css. Defaults
+	// to the directory of InputFile. Relative paths in the HTML are always
+	// resolved against the directory of InputFile. Local assets outside of
+	// both BaseDir and the directory of InputFile aren't read, like
+	// "../../etc/passwd" in untrusted HTML.
+	BaseDir string
+	// AllowedDirs lists further directories local assets may be read from,
+	// such as the root of a directory tree whose pages share assets
+	AllowedDirs []string
+	// NoFollowSymlinks refuses to read local assets through a symbolic link
+	// below BaseDir or the directory of InputFile
+	NoFollowSymlinks bool
+	// PublicPrefix limits the rooted paths that get embedded to the ones
+	// starting with it, e.g. "/_next" for a Next.js export. Defaults to "/",
+	// embedding every rooted path.
+	PublicPrefix string
+	// Rewrites map URL prefixes used in the document to the ones the assets
+	// can be found under, e.g. https://example.com/_next to /_next. They're
+	// applied to stylesheet, script, image, media and CSS url() references
+	// before they're resolved, the first matching rewrite wins.
+	Rewrites []Rewrite
+	// RemoveJS removes all JavaScript code and references
+	RemoveJS bool
+	// RemoveExternalJS removes the scripts loaded with <script src>, their
+	// preload links, on* event handlers and javascript: URLs like RemoveJS,
+	// but keeps inline <script> blocks such as small config snippets. Can't
+	// be combined with InlineJS.
+	RemoveExternalJS bool
+	// RemoveNextData removes the <script id="__NEXT_DATA__"> element holding
+	// the page data of Next.js exports, which is only needed for hydration,
+	// leaving other scripts alone
+	RemoveNextData bool
+	// StripResourceHints removes <link rel="preconnect">, dns-prefetch,
+	// prefetch and prerender hints, which are useless in a standalone file
+	// and leak the hosts the assets came from
+	StripResourceHints bool
+	// RemoveElements lists selectors of elements to remove from the document,
+	// e.g. "iframe", "div#cookie-banner" or "img.tracking-pixel". Only tag
+	// names, #id and .class are supported.
+	RemoveElements []string
+	// KeepElements, when set, reduces the <body> to the elements matching
+	// any of these selectors, keeping the <head> so styles still apply.
+	// Supports the same selectors as RemoveElements.
+	KeepElements []string
+	// PrefixIDs is added to every id of the document and the references to
+	// them (#id links, aria-labelledby and other id lists, url(#id) and #id
+	// CSS selectors), so a snippet clipped with KeepElements doesn't clash
+	// with the ids of the page it gets embedded into. Not supported in
+	// streaming mode.
+	PrefixIDs string
+	// UnwrapNoscript replaces <noscript> elements with their content when
+	// removing JavaScript, promoting the fallback markup into the document
+	UnwrapNoscript bool
+	// InlineJS inlines external JavaScript files. Can't be combined with RemoveJS.
+	InlineJS bool
+	// Nonce is set as the nonce attribute of the <style> elements inlined
+	// stylesheets become and of inlined scripts, so they're allowed by a
+	// Content-Security-Policy. Inlined stylesheets keep the nonce of their
+	// <link> otherwise.
+	Nonce string
+	// SkipCSS leaves stylesheets linked via <link rel="stylesheet"> as
+	// external references instead of inlining them
+	SkipCSS bool
+	// SkipFonts leaves fonts referenced by inlined CSS as external references
+	SkipFonts bool
+	// SkipImages leaves images as external references instead of embedding them
+	SkipImages bool
+	// SkipFavicon leaves icons linked via <link rel="icon"> (and touch/mask
+	// icons) as external references
+	SkipFavicon bool
+	// EmbedMedia embeds the audio/video files referenced by <video>, <audio>
+	// and their <source> elements, up to MaxEmbedSize (1 MiB when unset)
+	EmbedMedia bool
+	// EmbedManifest inlines web app manifests linked via
+	// <link rel="manifest"> as data URLs, with the icons they reference
+	// embedded too
+	EmbedManifest bool
+	// InlineIframes knits the local HTML files referenced by <iframe src>,
+	// embedding their own assets, into the srcdoc attribute of the iframe.
+	// Iframes nested in those are inlined too, up to MaxIframeDepth levels.
+	InlineIframes bool
+	// EmbedMetaImages embeds the images of Open Graph and Twitter card
+	// <meta> tags (og:image, twitter:image and their variants). Most social
+	// networks can't read data URLs, so the previews of the output break.
+	EmbedMetaImages bool
+	// MaxIframeDepth is the number of levels of nested iframes InlineIframes
+	// inlines, 3 when zero
+	MaxIframeDepth int
+	// MaxEmbedSize leaves fonts, images and media files larger than this
+	// many bytes as external references. Zero means no limit.
+	MaxEmbedSize int64
+	// MaxOutputSize fails the file without writing any output when the
+	// rendered HTML is larger than this many bytes, a safety net against
+	// misconfigurations producing huge files. Zero means no limit.
+	MaxOutputSize int64
+	// Exclude lists glob patterns (as in path.Match) of assets that are
+	// always left external, e.g. "*.mp4" or "/_next/media/hero-*". They're
+	// matched against the reference, the path it resolves to and, for
+	// patterns without a slash, the file name.
+	Exclude []string
+	// IgnoreMissing lists glob patterns, matched as Exclude patterns are, of
+	// assets known to be missing (e.g. dev-only files). They're left external
+	// as other unreadable assets are, but without a warning.
+	IgnoreMissing []string
+	// FetchRemote downloads and embeds assets referenced by absolute
+	// http/https URLs
+	FetchRemote bool
+	// FetchTimeout bounds each remote download. Defaults to 30 seconds.
+	FetchTimeout time.Duration
+	// Timeout bounds the whole run, no output is written when it's exceeded.
+	// Zero means no limit.
+	Timeout time.Duration
+	// Minify strips comments, empty class, id and style attributes and
+	// insignificant whitespace from the output
+	Minify bool
+	// PreferWOFF2 keeps only the woff2 source of @font-face rules listing
+	// several formats (or the first source when there's no woff2 one), so a
+	// single font file gets embedded
+	PreferWOFF2 bool
+	// PruneUnusedFonts drops the @font-face rules (and so the font files) of
+	// families never mentioned in the document or its stylesheets outside of
+	// @font-face rules. It's a conservative heuristic rather than a cascade
+	// analysis: a family mentioned anywhere counts as used, and nothing gets
+	// pruned when a linked stylesheet can't be read.
+	PruneUnusedFonts bool
+	// Pretty indents the output with two spaces per nesting level, for
+	// debugging. Can't be combined with Minify.
+	Pretty bool
+	// WrapDataURLs hard-wraps the base64 data URLs in <style> elements at
+	// this many columns, to make the output easier to inspect and diff. Data
+	// URLs in attributes can't be wrapped and are left as is. Zero disables
+	// wrapping.
+	WrapDataURLs int
+	// SelfCloseVoid writes void elements XHTML-style, e.g. <br/>, as some
+	// email clients and tools expect. The rendered document always is, so
+	// this only changes the tags Streaming copies as written.
+	SelfCloseVoid bool
+	// MergeStyles concatenates the <style> elements of the document
+	// (including the ones stylesheets got inlined into) into a single one
+	MergeStyles bool
+	// MinifyCSS strips comments and formatting whitespace from inlined CSS
+	MinifyCSS bool
+	// StripComments removes HTML comments, except for conditional comments
+	// (<!--[if IE]>) unless StripConditionalComments is set as well
+	StripComments            bool
+	StripConditionalComments bool
+	// BaseHref is set as the href of a <base> element added first in the
+	// <head> (replacing any other), so the relative links left in the
+	// output, such as <a href="page2.html">, resolve against it wherever the
+	// file is moved. Ignored for fragments.
+	BaseHref string
+	// CheckAnchors warns about the links to a #fragment of the document that
+	// no element has as id (or as <a name>), e.g. after KeepElements or
+	// RemoveElements removed their target
+	CheckAnchors bool
+	// StripDeadAnchors removes the href of those links instead, leaving the
+	// link text
+	StripDeadAnchors bool
+	// Lang sets the lang attribute of the <html> element, replacing the one
+	// of the input
+	Lang string
+	// Charset is the character encoding declared by the <meta charset> of
+	// the output, replacing the one of the input. A <meta charset="utf-8">
+	// is added to documents that don't declare one when it's empty. The
+	// content isn't transcoded, so a declared charset can only be replaced
+	// with another name of the same encoding, such as utf8 with utf-8.
+	// Not supported in streaming mode, which never adds one.
+	Charset string
+	// CommentBanner is added as a HTML comment at the top of the output to
+	// record where it came from, e.g. "knitted from {input} on {date}".
+	// {input} is replaced with the name of the input file, {date} with the
+	// date of BannerTime and {time} with BannerTime. It's added after
+	// comments get stripped, so it's kept by StripComments and Minify.
+	CommentBanner string
+	// BannerTime is the time the CommentBanner records, the current time when
+	// zero. Set it (e.g. from SOURCE_DATE_EPOCH) for reproducible output.
+	BannerTime time.Time
+	// Gzip and Brotli write pre-compressed copies of the output next to it,
+	// with a .gz / .br extension added. CompressionLevel applies to both, 0
+	// picks each format's default.
+	Gzip             bool
+	Brotli           bool
+	CompressionLevel int
+	// CompressOnly skips writing the uncompressed output file
+	CompressOnly bool
+	// Strict turns warnings about assets that can't be embedded into errors
+	Strict bool
+	// Verify parses the output back before writing it and warns when its
+	// elements differ from the processed document's, which would mean the
+	// processing produced markup that doesn't parse as intended. In strict
+	// mode no output is written then. Not supported in streaming mode.
+	Verify bool
+	// Concurrency is the number of assets loaded and encoded in parallel.
+	// Defaults to GOMAXPROCS.
+	Concurrency int
+	// LogLevel controls what gets logged, warnings by default
+	LogLevel LogLevel
+	// Logger receives the log messages. Defaults to the standard logger.
+	Logger *log.Logger
+	// MIMETypes overrides or adds MIME types by file extension, e.g.
+	// {".ttf": "application/font-sfnt"}
+	MIMETypes map[string]string
+	// ExtractAssets reverses embedding: the data: URLs of the document
+	// (including the ones embedded by this run) are written to files in this
+	// directory, named after a hash of their content, and referenced from
+	// there instead
+	ExtractAssets string
+	// Streaming processes the input a token at a time and writes the output
+	// as it goes, instead of building the whole document tree, so very large
+	// files can be knitted with little memory. Options that work on the whole
+	// tree (KeepElements, UnwrapNoscript, Minify, Pretty, MergeStyles,
+	// ExtractAssets, CommentBanner, Charset, BaseHref, Verify, PrefixIDs,
+	// XHTML, PruneUnusedFonts, WrapDataURLs, CheckAnchors, StripDeadAnchors)
+	// and compressed copies aren't supported. SVG sprites aren't inlined and
+	// resource hints for inlined assets are kept.
+	Streaming bool
+	// Cache holds loaded assets. Share one between runs over files that
+	// reference the same assets to only read and encode them once. A fresh
+	// cache is used when nil.
+	Cache *Cache
+}
+
+// Rewrite replaces the From prefix of asset references with To
+type Rewrite struct {
+	From string
+	To   string
+}
+
+// Default timeout for downloading a remote asset
+const defaultFetchTimeout = 30 * time.Second
+
+// Default number of levels of nested iframes inlined
+const defaultMaxIframeDepth = 3
+
+// Errors returned by Knit for invalid options
+var (
+	ErrNoInput               = errors.New("htmlknitter: input file path is required")
+	ErrNoOutput              = errors.New("htmlknitter: output file path is required")
+	ErrConflictingJS         = errors.New("htmlknitter: RemoveJS and InlineJS are mutually exclusive")
+	ErrConflictingExternalJS = errors.New("htmlknitter: RemoveExternalJS and InlineJS are mutually exclusive")
+	ErrNoCompression         = errors.New("htmlknitter: CompressOnly requires Gzip or Brotli")
+	ErrConflictingFormat     = errors.New("htmlknitter: Minify and Pretty are mutually exclusive")
+)
+
+// Error records a failed step of the knitting process and the file involved
+type Error struct {
+	Op   string // e.g. "opening input file"
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("error %s %s: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrOutputTooLarge is wrapped by the error returned when the output is
+// larger than MaxOutputSize
+var ErrOutputTooLarge = errors.New("output too large")
+
+// checkOutputSize fails when size bytes of output are over MaxOutputSize
+func (cfg *config) checkOutputSize(size int64) error {
+	if cfg.MaxOutputSize <= 0 || size <= cfg.MaxOutputSize {
+		return nil
+	}
+	err := fmt.Errorf("%w: %d bytes is over the %d bytes limit", ErrOutputTooLarge, size, cfg.MaxOutputSize)
+	return &Error{Op: "rendering", Path: cfg.InputFile, Err: err}
+}
+
+// config holds the options of a single run along with its internal state
+type config struct {
+	Options
+	ctx         context.Context // cancels the run
+	client      *http.Client
+	sprites     map[string]*html.Node // parsed SVG sprites by resolved path
+	svgSymbols  map[string]bool       // sprite symbols already inlined
+	spriteSheet *html.Node
+	report      *Report
+	fontTypes   map[string]string      // font MIME types by extension
+	imageTypes  map[string]string      // image MIME types by extension
+	remove      []selector             // parsed RemoveElements
+	keep        []selector             // parsed KeepElements
+	inlined     map[string]bool        // normalized references of embedded assets
+	stylesheets map[string]bool        // inlined stylesheets by normalized reference and media
+	embeds      map[string]*embedCount // times each asset got embedded, by normalized reference
+	extracted   map[string][]byte      // assets extracted from data URLs by file name
+	extractRef  string                 // URL of the ExtractAssets directory from the output
+	fontUsage   string                 // text looked up by PruneUnusedFonts, lowercased
+	iframes     []string               // documents being knitted into the srcdoc of an iframe, outermost first
+	assets      fs.FS                  // where local assets are read from by KnitStream, the filesystem otherwise
+	err         error                  // first problem found in strict mode
+}
+
+// Knit processes the HTML file at opts.InputFile and writes the
+// self-contained result to opts.OutputFile, returning a summary of the
+// changes made.
+func Knit(opts Options) (*Report, error) {
+	return KnitContext(context.Background(), opts)
+}
+
+// KnitContext is like Knit, but stops when ctx is done (or opts.Timeout is
+// exceeded), in which case no output is written.
+func KnitContext(ctx context.Context, opts Options) (*Report, error) {
+	if opts.InputFile == "" {
+		return nil, ErrNoInput
+	}
+	if opts.OutputFile == "" && !opts.DryRun {
+		return nil, ErrNoOutput
+	}
+	if opts.CompressOnly && !opts.Gzip && !opts.Brotli {
+		return nil, ErrNoCompression
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	cfg, err := newConfig(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	process := processHTML
+	if opts.Streaming {
+		process = streamHTML
+	}
+	if err := process(cfg); err != nil {
+		return nil, err
+	}
+	return cfg.report, nil
+}
+
+// KnitStream is Knit for documents that don't live in files, e.g. in tests:
+// the HTML is read from in and the result written to out, with local assets
+// read from assets (such as an fstest.MapFS) instead of the filesystem, or
+// from the filesystem when nil. Rooted paths resolve against BaseDir within
+// assets (its root by default) and relative ones against the directory of
+// InputFile, which optionally names the document within assets. Options
+// writing files of their own (ExtractAssets, Gzip, Brotli) and Streaming
+// aren't supported. A Cache shouldn't be shared with runs reading another
+// filesystem.
+func KnitStream(in io.Reader, out io.Writer, assets fs.FS, opts Options) error {
+	unsupported := []struct {
+		set  bool
+		name string
+	}{
+		{opts.ExtractAssets != "", "ExtractAssets"},
+		{opts.Gzip || opts.Brotli || opts.CompressOnly, "compressed copies"},
+		{opts.Streaming, "Streaming"},
+	}
+	for _, option := range unsupported {
+		if option.set {
+			return fmt.Errorf("htmlknitter: KnitStream doesn't support %s", option.name)
+		}
+	}
+
+	if opts.BaseDir == "" {
+		opts.BaseDir = "."
+	}
+
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	cfg, err := newConfig(ctx, opts)
+	if err != nil {
+		return err
+	}
+	cfg.assets = assets
+
+	r, err := maybeGunzip(in)
+	if err != nil {
+		return &Error{Op: "decompressing input", Path: cfg.InputFile, Err: err}
+	}
+	input, err := io.ReadAll(r)
+	if err != nil {
+		return &Error{Op: "reading input", Path: cfg.InputFile, Err: err}
+	}
+	cfg.report.InputSize = int64(len(input))
+
+	output, err := knitHTML(cfg, input)
+	if err != nil {
+		return err
+	}
+	if cfg.DryRun {
+		return nil
+	}
+	if _, err := out.Write(output); err != nil {
+		return &Error{Op: "writing output", Path: cfg.OutputFile, Err: err}
+	}
+	return nil
+}
+
+// newConfig validates opts, fills in their defaults and sets up the state of
+// a run
+func newConfig(ctx context.Context, opts Options) (*config, error) {
+	if opts.RemoveJS && opts.InlineJS {
+		return nil, ErrConflictingJS
+	}
+	if opts.RemoveExternalJS && opts.InlineJS {
+		return nil, ErrConflictingExternalJS
+	}
+	if opts.Minify && opts.Pretty {
+		return nil, ErrConflictingFormat
+	}
+	if opts.Streaming {
+		if err := checkStreaming(opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.BaseDir == "" {
+		opts.BaseDir = filepath.Dir(opts.InputFile)
+	}
+	if opts.PublicPrefix == "" {
+		opts.PublicPrefix = defaultPublicPrefix
+	}
+	if opts.FetchTimeout == 0 {
+		opts.FetchTimeout = defaultFetchTimeout
+	}
+	if opts.MaxIframeDepth <= 0 {
+		opts.MaxIframeDepth = defaultMaxIframeDepth
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = runtime.GOMAXPROCS(0)
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.Default()
+	}
+	if opts.Cache == nil {
+		opts.Cache = NewCache()
+	}
+
+	for _, pattern := range opts.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("htmlknitter: invalid Exclude pattern %q: %w", pattern, err)
+		}
+	}
+	for _, pattern := range opts.IgnoreMissing {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("htmlknitter: invalid IgnoreMissing pattern %q: %w", pattern, err)
+		}
+	}
+
+	remove, err := parseSelectors(opts.RemoveElements)
+	if err != nil {
+		return nil, err
+	}
+	keep, err := parseSelectors(opts.KeepElements)
+	if err != nil {
+		return nil, err
+	}
+
+	fontTypes, imageTypes := mimeTypeMaps(opts.MIMETypes)
+
+	cfg := &config{
+		Options:     opts,
+		ctx:         ctx,
+		client:      &http.Client{Timeout: opts.FetchTimeout},
+		sprites:     make(map[string]*html.Node),
+		svgSymbols:  make(map[string]bool),
+		report:      &Report{},
+		fontTypes:   fontTypes,
+		imageTypes:  imageTypes,
+		remove:      remove,
+		keep:        keep,
+		inlined:     make(map[string]bool),
+		stylesheets: make(map[string]bool),
+		embeds:      make(map[string]*embedCount),
+		extracted:   make(map[string][]byte),
+	}
+	if opts.ExtractAssets != "" {
+		if cfg.extractRef, err = extractRef(cfg); err != nil {
+			return nil, &Error{Op: "resolving assets directory", Path: opts.ExtractAssets, Err: err}
+		}
+	}
+	return cfg, nil
+}
+
+func processHTML(cfg *config) error {
+	// Read input file
+	file, err := os.Open(cfg.InputFile)
+	if err != nil {
+		return &Error{Op: "opening input file", Path: cfg.InputFile, Err: err}
+	}
+	defer file.Close()
+
+	// Exports may ship gzip-compressed HTML
+	r, err := maybeGunzip(file)
+	if err != nil {
+		return &Error{Op: "decompressing input file", Path: cfg.InputFile, Err: err}
+	}
+	input, err := io.ReadAll(r)
+	if err != nil {
+		return &Error{Op: "reading input file", Path: cfg.InputFile, Err: err}
+	}
+
+	// The output gets the permissions of the input
+	info, err := file.Stat()
+	if err != nil {
+		return &Error{Op: "reading input file", Path: cfg.InputFile, Err: err}
+	}
+	perm := info.Mode().Perm()
+	cfg.report.InputSize = info.Size()
+
+	// Knit it
+	output, err := knitHTML(cfg, input)
+	if err != nil {
+		return err
+	}
+
+	// Only measure the output in dry-run mode
+	if cfg.DryRun {
+		return nil
+	}
+
+	// Write the extracted assets first, so the output never references
+	// missing files
+	if err := writeExtracted(cfg); err != nil {
+		return err
+	}
+
+	// Write the processed HTML
+	if !cfg.CompressOnly {
+		if err := writeOutput(cfg.OutputFile, output, perm); err != nil {
+			return err
+		}
+		cfg.report.OutputFiles = append(cfg.report.OutputFiles, cfg.OutputFile)
+	}
+
+	// Write pre-compressed copies
+	if cfg.Gzip {
+		data, err := gzipBytes(output, cfg.CompressionLevel)
+		if err != nil {
+			return &Error{Op: "compressing", Path: cfg.OutputFile + ".gz", Err: err}
+		}
+		if err := writeOutput(cfg.OutputFile+".gz", data, perm); err != nil {
+			return err
+		}
+		cfg.report.OutputFiles = append(cfg.report.OutputFiles, cfg.OutputFile+".gz")
+	}
+	if cfg.Brotli {
+		data, err := brotliBytes(output, cfg.CompressionLevel)
+		if err != nil {
+			return &Error{Op: "compressing", Path: cfg.OutputFile + ".br", Err: err}
+		}
+		if err := writeOutput(cfg.OutputFile+".br", data, perm); err != nil {
+			return err
+		}
+		cfg.report.OutputFiles = append(cfg.report.OutputFiles, cfg.OutputFile+".br")
+	}
+
+	return nil
+}
+
+// knitHTML processes the HTML document input and returns the rendered
+// result
+func knitHTML(cfg *config, input []byte) ([]byte, error) {
+	// The HTML parser ignores the slash of <div/>, spell such tags out
+	if cfg.XHTML {
+		input = expandSelfClosing(input)
+	}
+
+	// Parse HTML. With scripting disabled <noscript> content gets parsed as
+	// markup rather than text, which is needed to unwrap it.
+	scripting := html.ParseOptionEnableScripting(!(cfg.RemoveJS && cfg.UnwrapNoscript))
+	var doc *html.Node
+	var err error
+	if cfg.Fragment {
+		doc, err = parseFragment(input, scripting)
+	} else {
+		doc, err = html.ParseWithOptions(bytes.NewReader(input), scripting)
+	}
+	if err != nil {
+		return nil, &Error{Op: "parsing HTML", Path: cfg.InputFile, Err: err}
+	}
+
+	// Clip the document to the parts to keep, so only their assets get
+	// embedded
+	if len(cfg.keep) > 0 && !keepMatching(doc, cfg.keep) {
+		cfg.warnf("No element matches %s", strings.Join(cfg.KeepElements, ", "))
+	}
+
+	// Find the font families in use before stylesheets get inlined
+	if cfg.PruneUnusedFonts {
+		collectFontUsage(doc, input, cfg)
+	}
+
+	// Process the document
+	processNode(doc, cfg)
+	if cfg.err != nil {
+		return nil, &Error{Op: "processing", Path: cfg.InputFile, Err: cfg.err}
+	}
+	if err := cfg.ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && cfg.Timeout > 0 {
+			err = fmt.Errorf("timed out after %s: %w", cfg.Timeout, err)
+		}
+		return nil, &Error{Op: "processing", Path: cfg.InputFile, Err: err}
+	}
+
+	// Point out assets embedded several times
+	reportDuplicates(cfg)
+
+	// Declare the encoding, so embedded non-ASCII content isn't garbled
+	if !cfg.Fragment {
+		if err := ensureCharset(doc, cfg); err != nil {
+			return nil, &Error{Op: "declaring charset", Path: cfg.InputFile, Err: err}
+		}
+	}
+
+	// Resolve the links left relative against the configured URL
+	if cfg.BaseHref != "" && !cfg.Fragment {
+		setBaseHref(doc, cfg.BaseHref)
+	}
+
+	// Drop resource hints for assets that are now part of the document
+	removeInlinedPreloads(doc, cfg)
+
+	// Merge the inlined stylesheets
+	if cfg.MergeStyles {
+		mergeStyles(doc)
+	}
+
+	// Move embedded assets out to their own files
+	if cfg.ExtractAssets != "" {
+		extractAssets(doc, cfg)
+		if cfg.err != nil {
+			return nil, &Error{Op: "extracting assets", Path: cfg.InputFile, Err: cfg.err}
+		}
+	}
+
+	// Namespace the ids, so the output can be embedded into another page
+	if cfg.PrefixIDs != "" {
+		prefixIDs(doc, cfg.PrefixIDs)
+	}
+
+	// Look for links to parts of the document that are gone
+	if cfg.CheckAnchors || cfg.StripDeadAnchors {
+		checkAnchors(doc, cfg)
+		if cfg.err != nil {
+			return nil, &Error{Op: "checking anchors", Path: cfg.InputFile, Err: cfg.err}
+		}
+	}
+
+	// Drop styles and scripts left without content
+	removeEmptyElements(doc)
+
+	// Minify the processed document, or at least tidy up the whitespace left
+	// behind by removed elements
+	if cfg.Minify {
+		minifyNode(doc)
+	} else {
+		tidyHead(doc)
+	}
+
+	// Make the embedded assets readable for debugging
+	if cfg.WrapDataURLs > 0 {
+		wrapDataURLs(doc, cfg.WrapDataURLs, cfg)
+	}
+
+	// Record where the output came from
+	if cfg.CommentBanner != "" {
+		addBanner(doc, cfg)
+	}
+
+	// Or indent it for readability
+	if cfg.Pretty {
+		prettyNode(doc, 0)
+	}
+
+	// Keep the output well-formed XML
+	if cfg.XHTML {
+		prepareXHTML(doc)
+	}
+
+	// Render the processed HTML into a buffer sized for the embedded assets,
+	// data URLs taking about 4/3 of their size, so it isn't copied as it
+	// grows. Extracted assets are written out instead.
+	var buf bytes.Buffer
+	if cfg.ExtractAssets == "" {
+		r := cfg.report
+		buf.Grow(len(input) + int(r.StylesheetsSize+r.ScriptsSize+(r.FontsSize+r.ImagesSize+r.MediaSize)*4/3))
+	}
+	if cfg.XHTML {
+		if decl := xmlDeclaration(input); decl != "" {
+			buf.WriteString(decl + "\n")
+		}
+	}
+	if err := renderDocument(&buf, doc, rawDoctype(input)); err != nil {
+		return nil, &Error{Op: "rendering", Path: cfg.InputFile, Err: err}
+	}
+	cfg.report.OutputSize = int64(buf.Len())
+	if err := cfg.checkOutputSize(cfg.report.OutputSize); err != nil {
+		return nil, err
+	}
+
+	// Make sure the output parses back to what was rendered
+	if cfg.Verify {
+		verifyOutput(buf.Bytes(), doc, cfg, scripting)
+		if cfg.err != nil {
+			return nil, &Error{Op: "verifying output", Path: cfg.InputFile, Err: cfg.err}
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// parseFragment parses a HTML snippet as if it was the content of <body>,
+// returning a <body> element holding the parsed nodes. Rendering its children
+// gives back the snippet without document scaffolding.
+func parseFragment(input []byte, opts ...html.ParseOption) (*html.Node, error) {
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragmentWithOptions(bytes.NewReader(input), body, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		body.AppendChild(n)
+	}
+	return body, nil
+}
+
+// addBanner inserts the CommentBanner with its placeholders filled in before
+// the root element of doc, or at the start of a fragment
+func addBanner(doc *html.Node, cfg *config) {
+	now := cfg.BannerTime
+	if now.IsZero() {
+		now = time.Now()
+	}
+	text := strings.NewReplacer(
+		"{input}", filepath.Base(cfg.InputFile),
+		"{date}", now.Format(time.DateOnly),
+		"{time}", now.Format(time.RFC3339),
+	).Replace(cfg.CommentBanner)
+	// "--" can't appear in a comment
+	text = strings.ReplaceAll(text, "--", "- -")
+
+	banner := &html.Node{Type: html.CommentNode, Data: " " + text + " "}
+	before := doc.FirstChild
+	for before != nil && before.Type == html.DoctypeNode {
+		before = before.NextSibling
+	}
+	doc.InsertBefore(banner, before)
+}
+
+// rawDoctype returns the DOCTYPE declaration of the HTML document in data as
+// written, or "" if it has none
+func rawDoctype(data []byte) string {
+	z := html.NewTokenizer(bytes.NewReader(data))
+	for {
+		switch z.Next() {
+		case html.DoctypeToken:
+			return string(z.Raw())
+		case html.CommentToken:
+			// Comments may precede the DOCTYPE
+		case html.TextToken:
+			if len(bytes.TrimSpace(z.Raw())) > 0 {
+				return ""
+			}
+		default:
+			return ""
+		}
+	}
+}
+
+// renderDocument renders the children of doc to w like html.Render, except
+// for the DOCTYPE, which is written as found in the input (when known) since
+// rendering normalizes its case, spacing and quotes
+func renderDocument(w io.Writer, doc *html.Node, doctype string) error {
+	for c := doc.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.DoctypeNode && doctype != "" {
+			if _, err := io.WriteString(w, doctype); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := html.Render(w, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOutput writes data to the output file at path with the given
+// permissions. The data is written to a temporary file next to it which is
+// then renamed, so the output is either complete or left untouched.
+func writeOutput(path string, data []byte, perm fs.FileMode) error {
+	// Create temporary file in the output directory, so it can be renamed
+	outFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return &Error{Op: "creating output file", Path: path, Err: err}
+	}
+	tmpPath := outFile.Name()
+	defer os.Remove(tmpPath) // no-op once renamed
+
+	if _, err := outFile.Write(data); err != nil {
+		outFile.Close()
+		return &Error{Op: "writing output file", Path: path, Err: err}
+	}
+	if err := outFile.Chmod(perm); err != nil {
+		outFile.Close()
+		return &Error{Op: "writing output file", Path: path, Err: err}
+	}
+	if err := outFile.Close(); err != nil {
+		return &Error{Op: "writing output file", Path: path, Err: err}
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return &Error{Op: "writing output file", Path: path, Err: err}
+	}
+	return nil
+}
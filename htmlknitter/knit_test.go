@@ -0,0 +1,239 @@
+package htmlknitter
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// knitString knits the document input with the assets of fsys, failing the
+// test on error. Warnings are discarded unless opts has a Logger.
+func knitString(t testing.TB, fsys fs.FS, input string, opts Options) string {
+	t.Helper()
+	if opts.Logger == nil {
+		opts.Logger = log.New(io.Discard, "", 0)
+	}
+	var out bytes.Buffer
+	if err := KnitStream(strings.NewReader(input), &out, fsys, opts); err != nil {
+		t.Fatalf("KnitStream: %v", err)
+	}
+	return out.String()
+}
+
+// benchKnit knits the document input with the assets of fsys like
+// knitString, discarding the output so only the allocations of knitting are
+// measured
+func benchKnit(b *testing.B, fsys fs.FS, input string, opts Options) {
+	b.Helper()
+	opts.Logger = log.New(io.Discard, "", 0)
+	if err := KnitStream(strings.NewReader(input), io.Discard, fsys, opts); err != nil {
+		b.Fatalf("KnitStream: %v", err)
+	}
+}
+
+// knitFiles writes the document input to index.html next to the assets of
+// fsys and knits it with Knit, for the options KnitStream doesn't support.
+// It returns the output and the report.
+func knitFiles(t *testing.T, fsys fstest.MapFS, input string, opts Options) (string, *Report) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.CopyFS(dir, fsys); err != nil {
+		t.Fatal(err)
+	}
+	opts.InputFile = filepath.Join(dir, "index.html")
+	if err := os.WriteFile(opts.InputFile, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts.OutputFile = filepath.Join(dir, "out.html")
+	if opts.Logger == nil {
+		opts.Logger = log.New(io.Discard, "", 0)
+	}
+	report, err := Knit(opts)
+	if err != nil {
+		t.Fatalf("Knit: %v", err)
+	}
+	out, err := os.ReadFile(opts.OutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), report
+}
+
+// b64 returns the base64 encoding of s, as found in the data URLs of assets
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// assetPage returns a page whose stylesheet embeds the given number of fonts
+// and images, each of size bytes, along with the assets
+func assetPage(fonts, images, size int) (fstest.MapFS, string) {
+	fsys := fstest.MapFS{}
+	var css, body strings.Builder
+	for i := range fonts {
+		name := fmt.Sprintf("fonts/f%d.woff2", i)
+		fsys[name] = &fstest.MapFile{Data: assetData(name, size)}
+		fmt.Fprintf(&css, "@font-face{font-family:F%d;src:url(../%s) format(\"woff2\")}\n.f%d{font-family:F%d}\n", i, name, i, i)
+	}
+	for i := range images {
+		name := fmt.Sprintf("img/i%d.png", i)
+		fsys[name] = &fstest.MapFile{Data: assetData(name, size)}
+		fmt.Fprintf(&css, ".i%d{background:url(../%s)}\n", i, name)
+		fmt.Fprintf(&body, `<img src="%s" alt="">`, name)
+	}
+	fsys["css/app.css"] = &fstest.MapFile{Data: []byte(css.String())}
+	input := `<!DOCTYPE html><html><head><link rel="stylesheet" href="css/app.css"></head><body>` + body.String() + `</body></html>`
+	return fsys, input
+}
+
+// assetData returns size bytes of content unique to name
+func assetData(name string, size int) []byte {
+	data := bytes.Repeat([]byte(name), size/len(name)+1)
+	return data[:size]
+}
+
+func TestDoctypePreserved(t *testing.T) {
+	doctypes := []string{
+		`<!DOCTYPE html>`,
+		`<!doctype html>`,
+		`<!DOCTYPE html SYSTEM "about:legacy-compat">`,
+		`<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 3.2 Final//EN">`,
+		`<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 4.01//EN" "http://www.w3.org/TR/html4/strict.dtd">`,
+		`<!DOCTYPE html PUBLIC '-//W3C//DTD XHTML 1.0 Transitional//EN' 'http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd'>`,
+	}
+	for _, doctype := range doctypes {
+		got := knitString(t, fstest.MapFS{}, doctype+"\n<html><head></head><body>x</body></html>", Options{})
+		if !strings.HasPrefix(got, doctype+"<html>") {
+			t.Errorf("doctype %s not preserved:\n%s", doctype, got)
+		}
+	}
+}
+
+func TestAttributeOrderPreserved(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.png":  {Data: []byte("image a")},
+		"app.js": {Data: []byte("run()")},
+	}
+	input := `<html lang="en" data-theme="dark"><head></head><body>` +
+		`<div data-b="1" class="x" id="y" aria-label="z">` +
+		`<a title="t" href="https://example.com/" rel="noopener">x</a>` +
+		`<img width="10" src="a.png" alt="" loading="lazy">` +
+		`<script type="module" src="app.js" data-x="1"></script>` +
+		`</div></body></html>`
+	got := knitString(t, fsys, input, Options{InlineJS: true})
+	for _, want := range []string{
+		`<html lang="en" data-theme="dark">`,
+		`<div data-b="1" class="x" id="y" aria-label="z">`,
+		`<a title="t" href="https://example.com/" rel="noopener">`,
+		// Embedding only replaces the value of src, inlining drops it
+		`<img width="10" src="data:image/png;base64,` + b64("image a") + `" alt="" loading="lazy"/>`,
+		`<script type="module" data-x="1">run()</script>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output lacks %s:\n%s", want, got)
+		}
+	}
+}
+
+func TestDeterministicOutput(t *testing.T) {
+	fsys, input := assetPage(20, 20, 4096)
+	// Assets embedded twice get reported, in a stable order too
+	input = strings.Replace(input, "</body>", `<img src="img/i0.png" alt=""><img src="fonts/../img/i1.png" alt=""></body>`, 1)
+
+	var first, firstLogs string
+	for i := range 10 {
+		var logs bytes.Buffer
+		got := knitString(t, fsys, input, Options{Concurrency: 16, Logger: log.New(&logs, "", 0), LogLevel: LogVerbose})
+		if i == 0 {
+			first, firstLogs = got, logs.String()
+			continue
+		}
+		if got != first {
+			t.Fatalf("run %d differs from the first one", i+1)
+		}
+		if logs.String() != firstLogs {
+			t.Fatalf("run %d logged differently:\n%s\nfirst run:\n%s", i+1, logs.String(), firstLogs)
+		}
+	}
+}
+
+func BenchmarkExportSharedCache(b *testing.B) {
+	// 50 pages of an export sharing a stylesheet with 10 fonts and 20
+	// images, each with a few images of its own
+	fsys, page := assetPage(10, 20, 64<<10)
+	var pages []string
+	for i := range 50 {
+		var own strings.Builder
+		for j := range 3 {
+			name := fmt.Sprintf("img/page%d-%d.png", i, j)
+			fsys[name] = &fstest.MapFile{Data: assetData(name, 16<<10)}
+			fmt.Fprintf(&own, `<img src="%s" alt="">`, name)
+		}
+		pages = append(pages, strings.Replace(page, "</body>", own.String()+"</body>", 1))
+	}
+
+	caches := []struct {
+		name     string
+		newCache func() *Cache
+	}{
+		{"shared", NewCache},
+		{"shared-bounded", func() *Cache { return NewCacheSize(8 << 20) }},
+		{"per-page", nil},
+	}
+	for _, c := range caches {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				opts := Options{}
+				if c.newCache != nil {
+					opts.Cache = c.newCache()
+				}
+				for _, input := range pages {
+					benchKnit(b, fsys, input, opts)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoteReferencesLeftExternal(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app.css": {Data: []byte(`@import url("https://fonts.googleapis.com/css?family=Lato");
+@font-face{font-family:X;src:url(//cdn.example.com/x.woff2) format("woff2")}`)},
+	}
+	refs := map[string]string{
+		"https://fonts.googleapis.com/css2?family=Inter": "remote fetching disabled",
+		"https://fonts.googleapis.com/css?family=Lato":   "remote fetching disabled",
+		"https://cdn.example.com/app.js":                 "remote fetching disabled",
+		"//cdn.example.com/x.css":                        "protocol-relative URL",
+		"//cdn.example.com/x.js":                         "protocol-relative URL",
+		"//cdn.example.com/x.woff2":                      "protocol-relative URL",
+		"//cdn.example.com/x.png":                        "protocol-relative URL",
+	}
+	input := `<html><head>` +
+		`<link rel="stylesheet" href="https://fonts.googleapis.com/css2?family=Inter">` +
+		`<link rel="stylesheet" href="//cdn.example.com/x.css">` +
+		`<link rel="stylesheet" href="app.css">` +
+		`<script src="https://cdn.example.com/app.js"></script><script src="//cdn.example.com/x.js"></script>` +
+		`</head><body><img src="//cdn.example.com/x.png" alt=""></body></html>`
+	// Strict fails on any warning
+	got, report := knitFiles(t, fsys, input, Options{InlineJS: true, Strict: true})
+
+	for ref := range refs {
+		if !strings.Contains(got, ref) {
+			t.Errorf("%s not left in output:\n%s", ref, got)
+		}
+	}
+	for _, r := range report.Resources {
+		if want, ok := refs[r.URL]; ok && r.Reason != want {
+			t.Errorf("%s reported with reason %q, want %q", r.URL, r.Reason, want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package htmlknitter
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// LogLevel controls which messages are logged while knitting
+type LogLevel int
+
+const (
+	// LogQuiet logs nothing, problems are only returned as errors
+	LogQuiet LogLevel = iota - 1
+	// LogNormal logs warnings about assets that couldn't be processed
+	LogNormal
+	// LogVerbose also logs every asset embedded along with its size
+	LogVerbose
+)
+
+// warnf logs a warning about an asset that couldn't be processed. In strict
+// mode the first problem is recorded as the error of the run instead.
+func (cfg *config) warnf(format string, args ...any) {
+	if cfg.Strict {
+		if cfg.err == nil {
+			cfg.err = fmt.Errorf(format, args...)
+		}
+		return
+	}
+	cfg.report.Warnings++
+	if cfg.LogLevel >= LogNormal {
+		cfg.Logger.Printf("Warning: "+format, args...)
+	}
+}
+
+// unreadablef logs a warning about the asset at ref that couldn't be read
+// because of err. Missing files matching an IgnoreMissing pattern are
+// intentionally absent, and only logged in verbose mode.
+func (cfg *config) unreadablef(ref string, err error, format string, args ...any) {
+	if errors.Is(err, fs.ErrNotExist) && matchPattern(ref, cfg.IgnoreMissing, cfg) != "" {
+		cfg.debugf(format, args...)
+		return
+	}
+	cfg.warnf(format, args...)
+}
+
+// debugf logs details of the knitting process in verbose mode
+func (cfg *config) debugf(format string, args ...any) {
+	if cfg.LogLevel >= LogVerbose {
+		cfg.Logger.Printf(format, args...)
+	}
+}
@@ -0,0 +1,241 @@
+package htmlknitter
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Runs of whitespace that can be collapsed into a single space
+var whitespaceRegex = regexp.MustCompile(`[ \t\n\r\f]+`)
+
+// Elements whose text content must be preserved as is
+var preserveWhitespaceElements = map[string]bool{
+	"pre":      true,
+	"textarea": true,
+	"script":   true,
+	"style":    true,
+}
+
+// Attributes that mean the same when empty as when missing, and get dropped
+// then. Most other attributes carry meaning even when their value is empty,
+// such as boolean attributes, contenteditable="" and href="". (An empty
+// title isn't droppable either, it hides the title of the parent.)
+var droppableEmptyAttributes = map[string]bool{
+	"class": true,
+	"id":    true,
+	"style": true,
+}
+
+// minifyNode strips comments, empty attributes and insignificant whitespace
+// from the tree rooted at n
+func minifyNode(n *html.Node) {
+	switch n.Type {
+	case html.CommentNode:
+		n.Parent.RemoveChild(n)
+		return
+	case html.TextNode:
+		if n.Parent == nil || preserveWhitespaceElements[n.Parent.Data] {
+			return
+		}
+		text := whitespaceRegex.ReplaceAllString(n.Data, " ")
+		if prev := n.PrevSibling; prev != nil && prev.Type == html.TextNode && strings.HasSuffix(prev.Data, " ") {
+			// Adjacent text nodes (e.g. left behind by a removed comment)
+			text = strings.TrimPrefix(text, " ")
+		}
+		if text == "" {
+			n.Parent.RemoveChild(n)
+			return
+		}
+		if text == " " && (n.Parent.Data == "html" || n.Parent.Data == "head") {
+			// Whitespace between document-level elements never renders
+			n.Parent.RemoveChild(n)
+			return
+		}
+		n.Data = text
+		return
+	case html.ElementNode:
+		if preserveWhitespaceElements[n.Data] {
+			// Only attributes need minifying, the content is left untouched
+			removeEmptyAttributes(n)
+			return
+		}
+		removeEmptyAttributes(n)
+	}
+
+	// Process child nodes
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		minifyNode(c)
+		c = next
+	}
+}
+
+// tidyHead collapses the runs of whitespace-only text nodes left in the
+// <head> of doc by removed elements into one, keeping the whitespace that
+// came last so the next element keeps its indentation
+func tidyHead(doc *html.Node) {
+	head := findElement(doc, "head")
+	if head == nil {
+		return
+	}
+	for c := head.FirstChild; c != nil; c = c.NextSibling {
+		if !isWhitespaceText(c) {
+			continue
+		}
+		for next := c.NextSibling; next != nil && isWhitespaceText(next); next = c.NextSibling {
+			c.Data = next.Data
+			head.RemoveChild(next)
+		}
+	}
+}
+
+// Attributes that don't make an empty <style> or <script> worth keeping
+var disposableAttributes = map[string]bool{
+	"type": true, "media": true, "nonce": true,
+}
+
+// removeEmptyElements removes the <style> and <script> elements under n left
+// without content, e.g. by an empty stylesheet. Elements with other
+// attributes, such as a script src or an id scripts may look up, are kept.
+func removeEmptyElements(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		removeEmptyElements(c)
+		c = next
+	}
+
+	if n.Type != html.ElementNode || (n.Data != "style" && n.Data != "script") || n.Parent == nil {
+		return
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if !isWhitespaceText(c) {
+			return
+		}
+	}
+	for _, a := range n.Attr {
+		if !disposableAttributes[a.Key] {
+			return
+		}
+	}
+	n.Parent.RemoveChild(n)
+}
+
+// isWhitespaceText reports whether n is a text node holding only whitespace
+func isWhitespaceText(n *html.Node) bool {
+	return n.Type == html.TextNode && strings.Trim(n.Data, " \t\n\r\f") == ""
+}
+
+func removeEmptyAttributes(n *html.Node) {
+	newAttrs := make([]html.Attribute, 0, len(n.Attr))
+	for _, attr := range n.Attr {
+		if attr.Namespace == "" && strings.TrimSpace(attr.Val) == "" && droppableEmptyAttributes[attr.Key] {
+			continue
+		}
+		newAttrs = append(newAttrs, attr)
+	}
+	n.Attr = newAttrs
+}
+
+// minifyCSS strips comments, collapses whitespace and drops unnecessary
+// semicolons from a stylesheet. Strings and url() values (which may hold data
+// URLs) are copied verbatim.
+func minifyCSS(css string) string {
+	out := make([]byte, 0, len(css))
+	pendingSpace := false
+
+	for i := 0; i < len(css); {
+		c := css[i]
+
+		// Comments and whitespace
+		if c == '/' && i+1 < len(css) && css[i+1] == '*' {
+			end := strings.Index(css[i+2:], "*/")
+			if end < 0 {
+				break
+			}
+			i += end + 4
+			continue
+		}
+		if isCSSSpace(c) {
+			pendingSpace = true
+			i++
+			continue
+		}
+
+		// Only keep whitespace that separates tokens
+		if pendingSpace {
+			if len(out) > 0 && !isCSSPunctuation(out[len(out)-1]) && !isCSSPunctuation(c) {
+				out = append(out, ' ')
+			}
+			pendingSpace = false
+		}
+
+		switch {
+		case c == '"' || c == '\'':
+			end := cssStringEnd(css, i)
+			out = append(out, css[i:end]...)
+			i = end
+		case len(css)-i >= 4 && strings.EqualFold(css[i:i+4], "url("):
+			end := cssURLEnd(css, i+4)
+			out = append(out, css[i:end]...)
+			i = end
+		case c == ';':
+			// Drop repeated semicolons and ones opening a block
+			if len(out) > 0 && (out[len(out)-1] == ';' || out[len(out)-1] == '{') {
+				i++
+				continue
+			}
+			out = append(out, c)
+			i++
+		case c == '}':
+			// The last declaration of a block doesn't need a semicolon
+			if len(out) > 0 && out[len(out)-1] == ';' {
+				out = out[:len(out)-1]
+			}
+			out = append(out, c)
+			i++
+		default:
+			out = append(out, c)
+			i++
+		}
+	}
+	return string(out)
+}
+
+func isCSSSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// isCSSPunctuation reports whether whitespace around c is insignificant
+func isCSSPunctuation(c byte) bool {
+	return c == '{' || c == '}' || c == ';' || c == ',' || c == '>'
+}
+
+// cssStringEnd returns the index just past the string starting at css[start]
+func cssStringEnd(css string, start int) int {
+	quote := css[start]
+	for i := start + 1; i < len(css); i++ {
+		switch css[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1
+		}
+	}
+	return len(css)
+}
+
+// cssURLEnd returns the index just past the closing parenthesis of a url()
+// value whose content starts at css[start]
+func cssURLEnd(css string, start int) int {
+	for i := start; i < len(css); i++ {
+		switch css[i] {
+		case '"', '\'':
+			i = cssStringEnd(css, i) - 1
+		case ')':
+			return i + 1
+		}
+	}
+	return len(css)
+}
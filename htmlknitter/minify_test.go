@@ -0,0 +1,53 @@
+package htmlknitter
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmptyElementsRemoved(t *testing.T) {
+	fsys := fstest.MapFS{
+		"empty.css": {Data: []byte("")},
+		"blank.css": {Data: []byte(" \n ")},
+	}
+	tests := []struct {
+		name, element string
+		kept          bool
+	}{
+		{"empty stylesheet", `<link rel="stylesheet" href="empty.css">`, false},
+		{"blank stylesheet", `<link rel="stylesheet" href="blank.css" media="print">`, false},
+		{"empty style", `<style></style>`, false},
+		{"blank style", "<style type=\"text/css\">\n  </style>", false},
+		{"empty script", `<script></script>`, false},
+		{"blank script with nonce", `<script nonce="abc"> </script>`, false},
+		{"external script", `<script src="https://example.com/app.js"></script>`, true},
+		{"style with id", `<style id="theme"></style>`, true},
+		{"script with class", `<script class="config"></script>`, true},
+		{"style with content", `<style>p{}</style>`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := knitString(t, fsys, `<html><head>`+tt.element+`</head><body></body></html>`, Options{})
+			kept := strings.Contains(got, "<style") || strings.Contains(got, "<script")
+			if kept != tt.kept {
+				t.Errorf("kept = %v, want %v:\n%s", kept, tt.kept, got)
+			}
+		})
+	}
+}
+
+func TestMinify(t *testing.T) {
+	input := "<!DOCTYPE html>\n<html>\n<head>\n  <title>T</title>\n  <!-- comment -->\n</head>\n<body>\n" +
+		"  <div id=\"nav\" class=\"\" style=\" \">\n    <a href=\"#nav\">  x   y  </a>\n" +
+		"    <pre>  keep\n   this </pre>\n    <img src=\"x.png\" alt=\"\">\n  </div>\n</body>\n</html>\n"
+	got := knitString(t, fstest.MapFS{}, input, Options{Minify: true})
+
+	// Whitespace collapses to a space rather than going away, as it may
+	// separate inline content, and an empty alt marks a decorative image
+	want := `<!DOCTYPE html><html><head><meta charset="utf-8"/><title>T</title></head><body> ` +
+		`<div id="nav"> <a href="#nav"> x y </a> <pre>  keep` + "\n" + `   this </pre> <img src="x.png" alt=""/> </div> </body></html>`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
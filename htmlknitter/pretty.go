@@ -0,0 +1,94 @@
+package htmlknitter
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Elements laid out as blocks (or not rendered at all), around which
+// whitespace is insignificant
+var blockElements = map[string]bool{
+	"html": true, "head": true, "body": true, "title": true, "meta": true,
+	"link": true, "style": true, "script": true, "noscript": true, "template": true,
+	"base": true, "address": true, "article": true, "aside": true,
+	"blockquote": true, "dd": true, "details": true, "dialog": true, "div": true,
+	"dl": true, "dt": true, "fieldset": true, "figcaption": true, "figure": true,
+	"footer": true, "form": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "header": true, "hgroup": true, "hr": true, "li": true,
+	"main": true, "nav": true, "ol": true, "p": true, "pre": true, "section": true,
+	"summary": true, "table": true, "tbody": true, "td": true, "tfoot": true,
+	"th": true, "thead": true, "tr": true, "ul": true, "video": true,
+	"audio": true, "picture": true, "source": true, "caption": true,
+	"colgroup": true, "col": true, "menu": true, "search": true, "svg": true,
+}
+
+// prettyNode indents the tree rooted at n with two spaces per nesting level.
+// Only elements whose children are all blocks get re-indented, since
+// whitespace between inline content is significant, and whitespace-sensitive
+// elements (pre, textarea, script, style) are left alone.
+func prettyNode(n *html.Node, depth int) {
+	if n.Type == html.ElementNode && (preserveWhitespaceElements[n.Data] || n.Namespace != "") {
+		return
+	}
+
+	childDepth := depth + 1
+	if n.Type == html.DocumentNode {
+		childDepth = 0
+	}
+	if n.Type == html.DocumentNode || n.Type == html.ElementNode {
+		if hasOnlyBlockChildren(n) {
+			indentChildren(n, depth, childDepth)
+		}
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		prettyNode(c, childDepth)
+	}
+}
+
+// hasOnlyBlockChildren reports whether n has children and all of them are
+// blocks, comments or whitespace
+func hasOnlyBlockChildren(n *html.Node) bool {
+	if n.FirstChild == nil {
+		return false
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.TextNode:
+			if strings.TrimSpace(c.Data) != "" {
+				return false
+			}
+		case html.ElementNode:
+			if !blockElements[c.Data] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// indentChildren replaces the whitespace between the children of n with a
+// line break and indentation for each child
+func indentChildren(n *html.Node, depth, childDepth int) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.TextNode {
+			n.RemoveChild(c)
+		}
+		c = next
+	}
+
+	indent := "\n" + strings.Repeat("  ", childDepth)
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c == n.FirstChild && n.Type == html.DocumentNode {
+			continue
+		}
+		n.InsertBefore(&html.Node{Type: html.TextNode, Data: indent}, c)
+	}
+	if n.Type == html.DocumentNode {
+		n.AppendChild(&html.Node{Type: html.TextNode, Data: "\n"})
+	} else {
+		n.AppendChild(&html.Node{Type: html.TextNode, Data: "\n" + strings.Repeat("  ", depth)})
+	}
+}
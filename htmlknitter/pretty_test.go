@@ -0,0 +1,36 @@
+package htmlknitter
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestPretty(t *testing.T) {
+	input := `<!DOCTYPE html><html><head><title>T</title></head><body><main><p>hi <b>there</b></p>` +
+		"<ul><li>a</li><li>b</li></ul><pre>  keep\n this</pre></main></body></html>"
+	got := knitString(t, fstest.MapFS{}, input, Options{Pretty: true})
+
+	// Elements holding text are kept on one line, <pre> as written
+	want := `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8"/>
+    <title>T</title>
+  </head>
+  <body>
+    <main>
+      <p>hi <b>there</b></p>
+      <ul>
+        <li>a</li>
+        <li>b</li>
+      </ul>
+      <pre>  keep
+ this</pre>
+    </main>
+  </body>
+</html>
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
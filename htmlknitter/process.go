@@ -0,0 +1,464 @@
+package htmlknitter
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+func processNode(n *html.Node, cfg *config) {
+	// Stop as soon as a problem is found in strict mode, or the run is
+	// cancelled
+	if cfg.err != nil || cfg.ctx.Err() != nil {
+		return
+	}
+
+	if n.Type == html.CommentNode && cfg.StripComments {
+		if !isConditionalComment(n) || cfg.StripConditionalComments {
+			n.Parent.RemoveChild(n)
+			return
+		}
+	}
+
+	if n.Type == html.ElementNode {
+		if matchesAny(cfg.remove, n) {
+			n.Parent.RemoveChild(n)
+			return
+		}
+
+		switch n.Data {
+		case "html":
+			if cfg.Lang != "" {
+				setAttr(n, "lang", cfg.Lang)
+			}
+		case "script":
+			if cfg.RemoveNextData && getAttr(n, "id") == "__NEXT_DATA__" {
+				// Next.js page data, only needed for hydration
+				n.Parent.RemoveChild(n)
+				return
+			}
+			if cfg.RemoveJS || cfg.RemoveExternalJS && hasAttr(n, "src") {
+				// Mark node for removal
+				n.Parent.RemoveChild(n)
+				cfg.report.ScriptsRemoved++
+				return
+			}
+			if cfg.InlineJS {
+				// Inline external script
+				inlineScript(n, cfg)
+				return
+			}
+		case "noscript":
+			if cfg.RemoveJS && cfg.UnwrapNoscript {
+				// Promote the fallback content into the document
+				unwrapNode(n, cfg)
+				return
+			}
+		case "link":
+			if isPreloadJS(n) && (cfg.RemoveJS || cfg.RemoveExternalJS) {
+				// Remove preload links for JS files
+				n.Parent.RemoveChild(n)
+				return
+			} else if cfg.StripResourceHints && hasRel(n, "preconnect", "dns-prefetch", "prefetch", "prerender") {
+				// Remove resource hints
+				n.Parent.RemoveChild(n)
+				return
+			} else if isStylesheet(n) && !hasRel(n, "alternate") {
+				// Embed CSS. Alternate stylesheets are disabled until the
+				// user picks them, which an inlined <style> can't be.
+				embedCSS(n, cfg)
+			} else if isIcon(n) && !cfg.SkipFavicon {
+				// Embed favicon
+				embedIcon(n, cfg)
+			} else if hasRel(n, "manifest") && cfg.EmbedManifest {
+				// Embed web app manifest
+				embedManifest(n, cfg)
+			}
+		case "img", "source":
+			if !cfg.SkipImages {
+				embedImage(n, cfg)
+			}
+			if n.Data == "source" {
+				embedMedia(n, cfg)
+			}
+		case "video", "audio":
+			embedMedia(n, cfg)
+		case "input":
+			if strings.EqualFold(getAttr(n, "type"), "image") && !cfg.SkipImages {
+				embedImage(n, cfg)
+			}
+		case "object", "embed":
+			embedObject(n, cfg)
+		case "iframe":
+			if cfg.InlineIframes {
+				embedIframe(n, cfg)
+			}
+		case "meta":
+			if cfg.EmbedMetaImages && isMetaImage(n) {
+				if dataURL, ok := imageDataURL(getAttr(n, "content"), cfg); ok {
+					setAttr(n, "content", dataURL)
+				}
+			}
+		case "style":
+			// Embed the assets referenced by inline CSS
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				if c.Type == html.TextNode {
+					c.Data = processStyleText(c.Data, cfg)
+				}
+			}
+		case "use":
+			if !cfg.SkipImages {
+				embedSVGUse(n, cfg)
+			}
+		}
+
+		// Embed the assets referenced by style attributes, such as hero
+		// images set as a background
+		for i, a := range n.Attr {
+			if a.Key == "style" && strings.Contains(a.Val, "url(") {
+				n.Attr[i].Val = processCSSText(a.Val, cfg)
+			}
+		}
+
+		// Remove inline JavaScript attributes when removing JavaScript
+		if cfg.RemoveJS || cfg.RemoveExternalJS {
+			removeInlineJS(n)
+		}
+	}
+
+	// Process child nodes. The parser keeps the content of <template>
+	// elements as their children, so it gets embedded like the rest of the
+	// document.
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		processNode(c, cfg)
+		c = next
+	}
+}
+
+func inlineScript(n *html.Node, cfg *config) {
+	src := cfg.rewriteRef(getAttr(n, "src"))
+
+	// Leave inline scripts alone
+	if src == "" || !canEmbed(src, ResourceJS, cfg) {
+		return
+	}
+
+	// Read JS file
+	js, err := loadResource(src, cfg)
+	if err != nil {
+		cfg.unreadablef(src, err, "Could not read JS file %s: %v", resolvePath(src, cfg), err)
+		cfg.recordExternal(ResourceJS, src, err.Error())
+		return
+	}
+	cfg.recordEmbedded(ResourceJS, src, "text/javascript", len(js.data))
+
+	// Turn the element into an inline script in place, keeping the other
+	// attributes in their order (type="module" in particular, so modules
+	// keep their semantics)
+	removeAttr(n, "src")
+	removeFetchAttributes(n)
+	if cfg.Nonce != "" {
+		setAttr(n, "nonce", cfg.Nonce)
+	}
+
+	// Replace the content (ignored by browsers while src was set) with the
+	// JS, making sure it can't close the script element early
+	for n.FirstChild != nil {
+		n.RemoveChild(n.FirstChild)
+	}
+	n.AppendChild(&html.Node{
+		Type: html.TextNode,
+		Data: strings.ReplaceAll(string(js.data), "</script", "<\\/script"),
+	})
+	cfg.report.ScriptsInlined++
+}
+
+// unwrapNode replaces n with its children, which are then processed in its
+// place
+func unwrapNode(n *html.Node, cfg *config) {
+	parent, first, stop := n.Parent, n.FirstChild, n.NextSibling
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		n.RemoveChild(c)
+		parent.InsertBefore(c, n)
+		c = next
+	}
+	parent.RemoveChild(n)
+
+	// Process the promoted children, which the walk over the parent's
+	// children has already moved past
+	for c := first; c != nil && c != stop; {
+		next := c.NextSibling
+		processNode(c, cfg)
+		c = next
+	}
+}
+
+// removeInlinedPreloads removes preload/prefetch links pointing to assets
+// that got inlined. This runs after processNode since such links usually
+// come before the element referencing the asset.
+func removeInlinedPreloads(n *html.Node, cfg *config) {
+	if n.Type == html.ElementNode && n.Data == "link" && hasRel(n, "preload", "prefetch", "modulepreload") {
+		for _, a := range n.Attr {
+			if a.Key == "href" && cfg.inlined[normalizeRef(cfg.rewriteRef(a.Val), cfg)] {
+				n.Parent.RemoveChild(n)
+				return
+			}
+		}
+	}
+
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		removeInlinedPreloads(c, cfg)
+		c = next
+	}
+}
+
+// isConditionalComment reports whether n is an Internet Explorer conditional
+// comment such as <!--[if IE]> ... <![endif]-->
+func isConditionalComment(n *html.Node) bool {
+	data := strings.TrimSpace(n.Data)
+	return strings.HasPrefix(data, "[if ") || strings.HasSuffix(data, "<![endif]")
+}
+
+// isPreloadJS reports whether n is a <link> preloading a classic script or
+// an ES module
+func isPreloadJS(n *html.Node) bool {
+	if hasRel(n, "modulepreload") {
+		return true
+	}
+	return hasRel(n, "preload") && strings.EqualFold(getAttr(n, "as"), "script")
+}
+
+// Social preview <meta> properties whose content is an image URL
+var metaImageProperties = map[string]bool{
+	"og:image":            true,
+	"og:image:url":        true,
+	"og:image:secure_url": true,
+	"twitter:image":       true,
+	"twitter:image:src":   true,
+}
+
+// isMetaImage reports whether n is a <meta> giving the image of an Open Graph
+// or Twitter card social preview
+func isMetaImage(n *html.Node) bool {
+	for _, a := range n.Attr {
+		if (a.Key == "property" || a.Key == "name") && metaImageProperties[strings.ToLower(a.Val)] {
+			return true
+		}
+	}
+	return false
+}
+
+// isIcon reports whether n is a <link> to a favicon or touch icon
+func isIcon(n *html.Node) bool {
+	return hasRel(n, "icon", "apple-touch-icon", "apple-touch-icon-precomposed", "mask-icon")
+}
+
+// hasRel reports whether the space-separated rel attribute of n contains any
+// of the given values
+func hasRel(n *html.Node, values ...string) bool {
+	for _, a := range n.Attr {
+		if a.Key != "rel" {
+			continue
+		}
+		for _, token := range strings.Fields(strings.ToLower(a.Val)) {
+			for _, value := range values {
+				if token == value {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// setBaseHref makes href the base URL of doc with a <base> element placed
+// first in the <head>. An existing <base> is moved there, keeping its target,
+// and any other is removed.
+func setBaseHref(doc *html.Node, href string) {
+	head := findElement(doc, "head")
+	if head == nil {
+		return
+	}
+
+	var base *html.Node
+	for existing := findElement(doc, "base"); existing != nil; existing = findElement(doc, "base") {
+		existing.Parent.RemoveChild(existing)
+		if base == nil {
+			base = existing
+		}
+	}
+	if base == nil {
+		base = &html.Node{Type: html.ElementNode, Data: "base", DataAtom: atom.Base}
+	}
+	setAttr(base, "href", href)
+	head.InsertBefore(base, head.FirstChild)
+}
+
+// ensureCharset makes sure the <head> of doc declares its character
+// encoding, inserting a <meta charset> at its start when it doesn't. The
+// declared charset is replaced with cfg.Charset when set, utf-8 is used for
+// inserted declarations otherwise. The content isn't transcoded, so replacing
+// a declared charset with a different encoding fails unless both are UTF-8.
+func ensureCharset(doc *html.Node, cfg *config) error {
+	head := findElement(doc, "head")
+	if head == nil {
+		return nil
+	}
+
+	found := false
+	for c := head.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.Data != "meta" {
+			continue
+		}
+		for i, a := range c.Attr {
+			var declared string
+			switch {
+			case a.Key == "charset":
+				declared = a.Val
+			case a.Key == "content" && strings.EqualFold(getAttr(c, "http-equiv"), "content-type"):
+				_, declared, _ = strings.Cut(strings.ToLower(a.Val), "charset=")
+			default:
+				continue
+			}
+			found = true
+			if cfg.Charset == "" {
+				continue
+			}
+			declared = strings.Trim(strings.TrimSpace(declared), `"'`)
+			if !strings.EqualFold(declared, cfg.Charset) && !(isUTF8(declared) && isUTF8(cfg.Charset)) {
+				return fmt.Errorf("can't declare %s instead of %s without transcoding the content", cfg.Charset, declared)
+			}
+			if a.Key == "charset" {
+				c.Attr[i].Val = cfg.Charset
+			} else {
+				c.Attr[i].Val = "text/html; charset=" + cfg.Charset
+			}
+		}
+	}
+	if found {
+		return nil
+	}
+
+	charset := cfg.Charset
+	if charset == "" {
+		charset = "utf-8"
+	}
+	head.InsertBefore(&html.Node{
+		Type:     html.ElementNode,
+		Data:     "meta",
+		DataAtom: atom.Meta,
+		Attr:     []html.Attribute{{Key: "charset", Val: charset}},
+	}, head.FirstChild)
+	return nil
+}
+
+// isUTF8 reports whether charset is a name of the UTF-8 encoding
+func isUTF8(charset string) bool {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "utf-8", "utf8", "unicode-1-1-utf-8":
+		return true
+	}
+	return false
+}
+
+// getAttr returns the value of the attribute key of n, or "" if it's missing
+func getAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// hasAttr reports whether n has the attribute key
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// removeAttr removes the attribute key from n
+func removeAttr(n *html.Node, key string) {
+	attrs := n.Attr[:0]
+	for _, a := range n.Attr {
+		if a.Key != key {
+			attrs = append(attrs, a)
+		}
+	}
+	n.Attr = attrs
+}
+
+// setAttr sets the attribute key of n to val, adding it when missing
+func setAttr(n *html.Node, key, val string) {
+	for i, a := range n.Attr {
+		if a.Key == key {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
+
+// isStylesheet reports whether n is a <link> to a stylesheet, including
+// alternate ones
+func isStylesheet(n *html.Node) bool {
+	return hasRel(n, "stylesheet")
+}
+
+// removeFetchAttributes removes the attributes that only apply to fetching
+// the resource of an element that got inlined: subresource integrity hashes
+// no longer match (and are meaningless on inline content), and CORS settings
+// have nothing left to apply to
+func removeFetchAttributes(n *html.Node) {
+	attrs := n.Attr[:0]
+	for _, a := range n.Attr {
+		if a.Key != "integrity" && a.Key != "crossorigin" {
+			attrs = append(attrs, a)
+		}
+	}
+	n.Attr = attrs
+}
+
+// Attributes holding URLs that get loaded or navigated to
+var urlAttributes = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"data":       true,
+	"poster":     true,
+}
+
+func removeInlineJS(n *html.Node) {
+	// Create new attribute list without JavaScript event handlers (every
+	// on* attribute, so new handlers are caught too), javascript: URLs and
+	// data:text/html URLs, which can run scripts when loaded
+	newAttrs := make([]html.Attribute, 0, len(n.Attr))
+	for _, attr := range n.Attr {
+		if strings.HasPrefix(attr.Key, "on") {
+			continue
+		}
+		if urlAttributes[attr.Key] && (hasURLPrefix(attr.Val, "javascript:") || hasURLPrefix(attr.Val, "data:text/html")) {
+			continue
+		}
+		newAttrs = append(newAttrs, attr)
+	}
+	n.Attr = newAttrs
+}
+
+// hasURLPrefix reports whether the URL val starts with prefix. Like browsers,
+// it ignores surrounding whitespace, tabs/newlines inside the URL and case.
+func hasURLPrefix(val, prefix string) bool {
+	val = strings.TrimSpace(val)
+	val = strings.NewReplacer("\t", "", "\n", "", "\r", "").Replace(val)
+	return len(val) >= len(prefix) && strings.EqualFold(val[:len(prefix)], prefix)
+}
@@ -0,0 +1,85 @@
+package htmlknitter
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestTemplateAssets(t *testing.T) {
+	fsys := fstest.MapFS{
+		"card.css": {Data: []byte(`.card{border:1px solid}`)},
+		"a.png":    {Data: []byte("image a")},
+		"b.png":    {Data: []byte("image b")},
+	}
+	input := `<html><head></head><body><template id="card">` +
+		`<link rel="stylesheet" href="card.css">` +
+		`<style>.card{background:url(b.png)}</style>` +
+		`<img src="a.png" alt="">` +
+		`</template></body></html>`
+	got := knitString(t, fsys, input, Options{})
+	for _, want := range []string{
+		`<template id="card"><style type="text/css">.card{border:1px solid}</style>`,
+		"url(data:image/png;base64," + b64("image b") + ")",
+		`<img src="data:image/png;base64,` + b64("image a") + `"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output lacks %s:\n%s", want, got)
+		}
+	}
+}
+
+func TestMultiTokenRel(t *testing.T) {
+	fsys := fstest.MapFS{"app.css": {Data: []byte(`p{color:red}`)}}
+	tests := []struct {
+		link     string
+		opts     Options
+		wantLink bool
+	}{
+		{`<link rel="preload stylesheet" as="style" href="app.css">`, Options{}, false},
+		{`<link rel="Stylesheet" href="app.css">`, Options{}, false},
+		{"<link rel=\" stylesheet\tprefetch \" href=\"app.css\">", Options{}, false},
+		{`<link rel="alternate stylesheet" title="Dark" href="app.css">`, Options{}, true},
+		{`<link rel="preload prefetch" as="script" href="app.js">`, Options{RemoveJS: true}, false},
+		{`<link rel="MODULEPRELOAD" href="app.js">`, Options{RemoveJS: true}, false},
+		{`<link rel="preload" as="style" href="app.css">`, Options{RemoveJS: true}, true},
+	}
+	for _, tt := range tests {
+		got := knitString(t, fsys, `<html><head>`+tt.link+`</head><body></body></html>`, tt.opts)
+		if hasLink := strings.Contains(got, "<link"); hasLink != tt.wantLink {
+			t.Errorf("%s: <link> kept = %v, want %v:\n%s", tt.link, hasLink, tt.wantLink, got)
+		}
+	}
+}
+
+func TestPublicPrefixStylesheetsAndScripts(t *testing.T) {
+	fsys := fstest.MapFS{
+		"static/app.css": {Data: []byte(`.a{color:red}`)},
+		"static/app.js":  {Data: []byte(`run()`)},
+		"other/app.css":  {Data: []byte(`.b{color:blue}`)},
+		"other/app.js":   {Data: []byte(`skip()`)},
+	}
+	input := `<html><head><link rel="stylesheet" href="/static/app.css"><link rel="stylesheet" href="/other/app.css"></head>` +
+		`<body><script src="/static/app.js"></script><script src="/other/app.js"></script></body></html>`
+	got, report := knitFiles(t, fsys, input, Options{PublicPrefix: "/static", InlineJS: true})
+
+	for _, want := range []string{".a{color:red}", "<script>run()</script>", `href="/other/app.css"`, `<script src="/other/app.js">`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output lacks %s:\n%s", want, got)
+		}
+	}
+	external := map[string]string{}
+	for _, r := range report.Resources {
+		if r.Reason != "" {
+			external[r.URL] = r.Reason
+		}
+	}
+	for _, ref := range []string{"/other/app.css", "/other/app.js"} {
+		if reason := external[ref]; reason != "not under /static" {
+			t.Errorf("%s reported with reason %q, want %q", ref, reason, "not under /static")
+		}
+	}
+	if report.Warnings != 0 {
+		t.Errorf("%d warnings, want none", report.Warnings)
+	}
+}
@@ -0,0 +1,107 @@
+package htmlknitter
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var fontFamilyRegex = regexp.MustCompile(`font-family\s*:\s*([^;}]+)`)
+
+// collectFontUsage gathers the text PruneUnusedFonts looks font families up
+// in: the input document along with the stylesheets it links or imports,
+// lowercased and without their @font-face rules. Pruning is turned off when
+// a linked stylesheet can't be read, as it might use any font.
+func collectFontUsage(doc *html.Node, input []byte, cfg *config) {
+	var b strings.Builder
+	b.WriteString(fontFaceRegex.ReplaceAllString(string(input), ""))
+
+	visited := make(map[string]bool)
+	complete := true
+	var addStylesheet func(ref string)
+	var addImports func(css, parent string)
+	addStylesheet = func(ref string) {
+		key := normalizeRef(ref, cfg)
+		if visited[key] {
+			return
+		}
+		visited[key] = true
+		if !shouldEmbed(ref, cfg) {
+			complete = false
+			return
+		}
+		res, err := loadResource(ref, cfg)
+		if err != nil {
+			// Reported when the stylesheet gets inlined
+			complete = false
+			return
+		}
+		css := string(res.data)
+		b.WriteString(fontFaceRegex.ReplaceAllString(css, ""))
+		addImports(css, ref)
+	}
+	addImports = func(css, parent string) {
+		for _, m := range importRegex.FindAllStringSubmatch(css, -1) {
+			importRef := m[1]
+			if importRef == "" {
+				importRef = m[2]
+			}
+			addStylesheet(resolveCSSRef(cfg.rewriteRef(importRef), parent))
+		}
+	}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "link" && isStylesheet(n) {
+			if href := cfg.rewriteRef(getAttr(n, "href")); href != "" && !isDataURL(href) {
+				addStylesheet(href)
+			}
+		}
+		if n.Type == html.ElementNode && n.Data == "style" && !cfg.SkipCSS {
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				if c.Type == html.TextNode {
+					addImports(c.Data, "")
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	if !complete {
+		cfg.debugf("Not pruning unused fonts: a linked stylesheet can't be read")
+		cfg.PruneUnusedFonts = false
+		return
+	}
+	cfg.fontUsage = strings.ToLower(b.String())
+}
+
+// pruneUnusedFonts removes the @font-face rules of css whose family isn't
+// mentioned anywhere in the document or its stylesheets, returning the
+// pruned css along with the rules left
+func pruneUnusedFonts(css string, fontFaces []string, cfg *config) (string, []string) {
+	var kept []string
+	for _, fontFace := range fontFaces {
+		family := fontFaceFamily(fontFace)
+		if family == "" || strings.Contains(cfg.fontUsage, strings.ToLower(family)) {
+			kept = append(kept, fontFace)
+			continue
+		}
+		cfg.debugf("Pruning unused font %q", family)
+		css = strings.Replace(css, fontFace, "", 1)
+	}
+	return css, kept
+}
+
+// fontFaceFamily returns the font-family declared by an @font-face rule,
+// without quotes, or "" if there's none
+func fontFaceFamily(fontFace string) string {
+	m := fontFamilyRegex.FindStringSubmatch(fontFace)
+	if m == nil {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(m[1]), `'"`)
+}
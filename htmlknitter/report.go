@@ -0,0 +1,149 @@
+package htmlknitter
+
+import (
+	"maps"
+	"slices"
+)
+
+// Report summarizes the changes made while knitting a file
+type Report struct {
+	StylesheetsInlined int
+	FontsEmbedded      int
+	ImagesEmbedded     int
+	MediaEmbedded      int
+	ScriptsRemoved     int
+	ScriptsInlined     int
+	// AssetsExtracted counts the files data URLs were extracted to
+	AssetsExtracted int
+	// Total size in bytes of the embedded stylesheets (including imported
+	// ones), fonts, images and scripts, before encoding
+	StylesheetsSize int64
+	FontsSize       int64
+	ImagesSize      int64
+	MediaSize       int64
+	ScriptsSize     int64
+	// Warnings counts the problems logged while processing, such as assets
+	// that couldn't be embedded
+	Warnings int
+	// Resources lists every asset considered for embedding
+	Resources []Resource
+
+	// InputSize is the size of the input file in bytes
+	InputSize int64
+	// OutputSize is the size of the rendered HTML in bytes
+	OutputSize int64
+	// OutputFiles lists the files written, including compressed copies
+	OutputFiles []string
+}
+
+// Resource types reported in Resource.Type
+const (
+	ResourceCSS      = "css"
+	ResourceDocument = "document"
+	ResourceFont     = "font"
+	ResourceImage    = "image"
+	ResourceJS       = "js"
+	ResourceManifest = "manifest"
+	ResourceMedia    = "media"
+)
+
+// Resource describes an asset referenced by the document and whether it got
+// embedded
+type Resource struct {
+	// URL is the reference as it appears in the document or stylesheet
+	URL string `json:"url"`
+	// Path is the file or URL the reference resolved to
+	Path     string `json:"path"`
+	Type     string `json:"type"`
+	Size     int    `json:"size"`
+	MIMEType string `json:"mimeType,omitempty"`
+	Embedded bool   `json:"embedded"`
+	// Reason explains why the resource was left external
+	Reason string `json:"reason,omitempty"`
+}
+
+// recordEmbedded adds an embedded asset to the report
+func (cfg *config) recordEmbedded(kind, ref, mimeType string, size int) {
+	cfg.debugf("Embedded %s %s (%d bytes)", kind, resolvePath(ref, cfg), size)
+	key := normalizeRef(ref, cfg)
+	cfg.inlined[key] = true
+	if count, ok := cfg.embeds[key]; ok {
+		count.times++
+	} else {
+		cfg.embeds[key] = &embedCount{kind: kind, times: 1, size: size}
+	}
+	switch kind {
+	case ResourceCSS:
+		cfg.report.StylesheetsSize += int64(size)
+	case ResourceFont:
+		cfg.report.FontsSize += int64(size)
+	case ResourceImage:
+		cfg.report.ImagesSize += int64(size)
+	case ResourceMedia:
+		cfg.report.MediaSize += int64(size)
+	case ResourceJS:
+		cfg.report.ScriptsSize += int64(size)
+	}
+	cfg.report.Resources = append(cfg.report.Resources, Resource{
+		URL:      ref,
+		Path:     resolvePath(ref, cfg),
+		Type:     kind,
+		Size:     size,
+		MIMEType: mimeType,
+		Embedded: true,
+	})
+}
+
+// add adds the counts and resources of other, the report of a document
+// knitted into this one, leaving the input and output sizes alone
+func (r *Report) add(other *Report) {
+	r.StylesheetsInlined += other.StylesheetsInlined
+	r.FontsEmbedded += other.FontsEmbedded
+	r.ImagesEmbedded += other.ImagesEmbedded
+	r.MediaEmbedded += other.MediaEmbedded
+	r.ScriptsRemoved += other.ScriptsRemoved
+	r.ScriptsInlined += other.ScriptsInlined
+	r.AssetsExtracted += other.AssetsExtracted
+	r.StylesheetsSize += other.StylesheetsSize
+	r.FontsSize += other.FontsSize
+	r.ImagesSize += other.ImagesSize
+	r.MediaSize += other.MediaSize
+	r.ScriptsSize += other.ScriptsSize
+	r.Warnings += other.Warnings
+	r.Resources = append(r.Resources, other.Resources...)
+}
+
+// embedCount tracks how many times an asset got embedded
+type embedCount struct {
+	kind  string
+	times int
+	size  int
+}
+
+// reportDuplicates logs the assets embedded more than once in verbose mode,
+// along with the space wasted by the extra copies
+func reportDuplicates(cfg *config) {
+	for _, path := range slices.Sorted(maps.Keys(cfg.embeds)) {
+		count := cfg.embeds[path]
+		if count.times < 2 {
+			continue
+		}
+		wasted := int64(count.times-1) * int64(count.size)
+		if count.kind != ResourceCSS && count.kind != ResourceJS {
+			// Data URLs take about 4/3 of the size in base64
+			wasted = wasted * 4 / 3
+		}
+		cfg.debugf("Duplicate %s %s: embedded %d times, wasting ~%.1f KB", count.kind, path, count.times, float64(wasted)/(1<<10))
+	}
+}
+
+// recordExternal adds an asset that was left as an external reference to the
+// report, along with the reason
+func (cfg *config) recordExternal(kind, ref, reason string) {
+	cfg.report.Resources = append(cfg.report.Resources, Resource{
+		URL:    ref,
+		Path:   resolvePath(ref, cfg),
+		Type:   kind,
+		Reason: reason,
+	})
+}
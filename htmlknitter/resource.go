@@ -0,0 +1,286 @@
+package htmlknitter
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// resource is the content of an asset along with its MIME type, if the
+// source told us one
+type resource struct {
+	data     []byte
+	mimeType string
+	sum      [sha256.Size]byte
+	err      error         // cached so failing assets aren't loaded again
+	ready    chan struct{} // closed once loaded
+	elem     *list.Element // entry in the eviction order of the cache, once loaded
+}
+
+// encodingKey identifies a data URL by the MIME type and the hash of the
+// content it encodes
+type encodingKey struct {
+	mimeType string
+	sum      [sha256.Size]byte
+}
+
+// DefaultCacheSize is the size of the assets and data URLs a Cache created
+// by NewCache holds at most
+const DefaultCacheSize = 256 << 20
+
+// Cache holds assets loaded while knitting, keyed by resolved path, along with
+// the data URLs they were encoded to. The least recently used ones are dropped
+// once their size exceeds the bound of the cache, so sharing one across a
+// large batch doesn't keep every asset in memory, and ones larger than the
+// bound aren't kept at all. It is safe for concurrent use.
+type Cache struct {
+	mu            sync.Mutex
+	processedURLs map[string]*resource
+	dataURLs      map[encodingKey]*list.Element
+	maxSize       int64
+	size          int64
+	lru           *list.List // *cacheEntry, most recently used first
+}
+
+// cacheEntry is a loaded asset or a data URL held by a Cache
+type cacheEntry struct {
+	path string      // resolved path of a loaded asset
+	key  encodingKey // encoding of a data URL otherwise
+	url  string
+	size int64
+}
+
+// NewCache returns an empty asset cache holding up to DefaultCacheSize bytes
+func NewCache() *Cache {
+	return NewCacheSize(DefaultCacheSize)
+}
+
+// NewCacheSize returns an empty asset cache holding up to maxSize bytes of
+// assets and data URLs. Zero or less means no limit.
+func NewCacheSize(maxSize int64) *Cache {
+	return &Cache{
+		processedURLs: make(map[string]*resource),
+		dataURLs:      make(map[encodingKey]*list.Element),
+		maxSize:       maxSize,
+		lru:           list.New(),
+	}
+}
+
+// add records a new entry as the most recently used one. Entries larger than
+// the bound aren't kept, add returns nil for them. The caller holds mu and
+// calls trim once it has stored the element.
+func (c *Cache) add(entry *cacheEntry) *list.Element {
+	if c.maxSize > 0 && entry.size > c.maxSize {
+		return nil
+	}
+	c.size += entry.size
+	return c.lru.PushFront(entry)
+}
+
+// trim drops the least recently used entries over the bound. The caller holds
+// mu.
+func (c *Cache) trim() {
+	for c.maxSize > 0 && c.size > c.maxSize {
+		oldest := c.lru.Back()
+		evicted := c.lru.Remove(oldest).(*cacheEntry)
+		c.size -= evicted.size
+		if evicted.path != "" {
+			if res := c.processedURLs[evicted.path]; res != nil && res.elem == oldest {
+				delete(c.processedURLs, evicted.path)
+			}
+		} else {
+			delete(c.dataURLs, evicted.key)
+		}
+	}
+}
+
+// isRemote reports whether ref is an absolute http/https URL
+func isRemote(ref string) bool {
+	return strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://")
+}
+
+// loadResource reads the asset referenced by ref, downloading it when it's a
+// remote URL and fetching is enabled. Resources are cached by resolved path so
+// each one is only read once per cache, even when requested concurrently.
+func loadResource(ref string, cfg *config) (*resource, error) {
+	if err := cfg.ctx.Err(); err != nil {
+		return nil, err
+	}
+	path := resolvePath(ref, cfg)
+	cache := cfg.Cache
+	cache.mu.Lock()
+	res, ok := cache.processedURLs[path]
+	if ok {
+		// Wait for the load in progress, if any
+		cache.mu.Unlock()
+		<-res.ready
+		cache.mu.Lock()
+		if res.elem != nil {
+			cache.lru.MoveToFront(res.elem)
+		}
+		cache.mu.Unlock()
+		return res.result()
+	}
+	res = &resource{ready: make(chan struct{})}
+	cache.processedURLs[path] = res
+	cache.mu.Unlock()
+	defer close(res.ready)
+
+	var loaded *resource
+	var err error
+	if isRemote(ref) && cfg.FetchRemote {
+		loaded, err = fetchResource(ref, cfg)
+	} else {
+		var data []byte
+		if cfg.assets != nil {
+			data, err = fs.ReadFile(cfg.assets, filepath.ToSlash(path))
+		} else if err = checkAssetPath(path, cfg); err == nil {
+			data, err = os.ReadFile(path)
+		}
+		loaded = &resource{data: data}
+	}
+	if err != nil {
+		res.err = err
+		if cfg.ctx.Err() != nil {
+			// Cancelled rather than failed, a later run may load it
+			cache.mu.Lock()
+			delete(cache.processedURLs, path)
+			cache.mu.Unlock()
+		}
+	} else {
+		res.data = loaded.data
+		res.mimeType = loaded.mimeType
+		res.sum = sha256.Sum256(loaded.data)
+		cache.mu.Lock()
+		if res.elem = cache.add(&cacheEntry{path: path, size: int64(len(res.data))}); res.elem != nil {
+			cache.trim()
+		} else {
+			// Too large to keep, only the loads waiting for it share it
+			delete(cache.processedURLs, path)
+		}
+		cache.mu.Unlock()
+	}
+	return res.result()
+}
+
+// result returns the resource, or the error it failed to load with
+func (res *resource) result() (*resource, error) {
+	if res.err != nil {
+		return nil, res.err
+	}
+	return res, nil
+}
+
+// fetchResource downloads a remote asset
+func fetchResource(url string, cfg *config) (*resource, error) {
+	req, err := http.NewRequestWithContext(cfg.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cfg.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &resource{data: data}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+		res.mimeType = mediaType
+	}
+	return res, nil
+}
+
+// dataURL returns the data URL for a resource. Encodings are shared between
+// resources with identical content, so duplicates are only encoded once.
+func (cfg *config) dataURL(mimeType string, res *resource) string {
+	key := encodingKey{mimeType: mimeType, sum: res.sum}
+	cache := cfg.Cache
+	cache.mu.Lock()
+	if elem, ok := cache.dataURLs[key]; ok {
+		cache.lru.MoveToFront(elem)
+		cache.mu.Unlock()
+		return elem.Value.(*cacheEntry).url
+	}
+	cache.mu.Unlock()
+
+	url := encodeDataURL(mimeType, res.data)
+	cache.mu.Lock()
+	if _, ok := cache.dataURLs[key]; !ok {
+		if elem := cache.add(&cacheEntry{key: key, url: url, size: int64(len(url))}); elem != nil {
+			cache.dataURLs[key] = elem
+			cache.trim()
+		}
+	}
+	cache.mu.Unlock()
+	return url
+}
+
+// Errors for local asset paths refused by checkAssetPath
+var (
+	errOutsideRoot = errors.New("outside the asset root")
+	errSymlink     = errors.New("symbolic link")
+)
+
+// checkAssetPath refuses the local asset path when it lies outside of the
+// asset root, the directory of the input file and AllowedDirs, or when a part
+// of it below them is a symbolic link with NoFollowSymlinks
+func checkAssetPath(path string, cfg *config) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	var roots []string
+	for _, dir := range append([]string{cfg.BaseDir, filepath.Dir(cfg.InputFile)}, cfg.AllowedDirs...) {
+		root, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		roots = append(roots, root)
+	}
+
+	if !slices.ContainsFunc(roots, func(root string) bool { return isWithin(path, root) }) {
+		return errOutsideRoot
+	}
+	if cfg.NoFollowSymlinks {
+		// The roots themselves may be reached through links, what lies
+		// below them may not
+		for p := path; !slices.ContainsFunc(roots, func(root string) bool { return isWithin(root, p) }); p = filepath.Dir(p) {
+			info, err := os.Lstat(p)
+			if err != nil {
+				return err
+			}
+			if info.Mode()&fs.ModeSymlink != 0 {
+				return fmt.Errorf("%w: %s", errSymlink, p)
+			}
+			if p == filepath.Dir(p) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// isWithin reports whether path is dir or lies below it, both being absolute
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && filepath.IsLocal(rel)
+}
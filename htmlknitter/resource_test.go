@@ -0,0 +1,107 @@
+package htmlknitter
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCacheBound(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		entries int // assets and data URLs left in the cache
+	}{
+		// The asset and its data URL fit
+		{"small", 256, 2},
+		// The data URL alone is over the bound
+		{"data URL too large", 900, 1},
+		// Neither is kept, rather than evicting everything else
+		{"asset too large", 4096, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{"a.png": {Data: assetData("a.png", tt.size)}}
+			input := `<html><head></head><body><img src="a.png" alt=""></body></html>`
+			cache := NewCacheSize(1024)
+			for range 3 {
+				got := knitString(t, fsys, input, Options{Cache: cache})
+				if want := `src="data:image/png;base64,` + b64(string(fsys["a.png"].Data)) + `"`; !strings.Contains(got, want) {
+					t.Fatalf("image not embedded:\n%s", got)
+				}
+			}
+
+			if n := cache.lru.Len(); n != tt.entries {
+				t.Errorf("%d entries cached, want %d", n, tt.entries)
+			}
+			if n := len(cache.processedURLs) + len(cache.dataURLs); n != cache.lru.Len() {
+				t.Errorf("%d assets and data URLs indexed for %d entries", n, cache.lru.Len())
+			}
+			var size int64
+			for e := cache.lru.Front(); e != nil; e = e.Next() {
+				size += e.Value.(*cacheEntry).size
+			}
+			if size != cache.size || size > cache.maxSize {
+				t.Errorf("cache holds %d bytes, counted %d, bound %d", size, cache.size, cache.maxSize)
+			}
+		})
+	}
+}
+
+func TestAssetPathConfinement(t *testing.T) {
+	top := t.TempDir()
+	fsys := fstest.MapFS{
+		"site/index.html": {Data: []byte(`<html><head></head><body>` +
+			`<img src="a.png" alt=""><img src="../secret.png" alt=""><img src="link.png" alt="">` +
+			`</body></html>`)},
+		"site/a.png": {Data: []byte("image a")},
+		"secret.png": {Data: []byte("secret")},
+	}
+	if err := os.CopyFS(top, fsys); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..", "secret.png"), filepath.Join(top, "site", "link.png")); err != nil {
+		t.Skipf("no symbolic links: %v", err)
+	}
+
+	tests := []struct {
+		name            string
+		opts            Options
+		secret, viaLink bool // whether ../secret.png and link.png get embedded
+	}{
+		{"default", Options{}, false, true},
+		{"no-follow-symlinks", Options{NoFollowSymlinks: true}, false, false},
+		{"asset root above", Options{BaseDir: top}, true, true},
+		{"allowed dir above", Options{AllowedDirs: []string{top}}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.InputFile = filepath.Join(top, "site", "index.html")
+			opts.OutputFile = filepath.Join(t.TempDir(), "out.html")
+			opts.Logger = log.New(io.Discard, "", 0)
+			if _, err := Knit(opts); err != nil {
+				t.Fatalf("Knit: %v", err)
+			}
+			data, err := os.ReadFile(opts.OutputFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := string(data)
+
+			if !strings.Contains(got, b64("image a")) {
+				t.Errorf("a.png not embedded:\n%s", got)
+			}
+			if embedded := !strings.Contains(got, `src="../secret.png"`); embedded != tt.secret {
+				t.Errorf("../secret.png embedded: %t, want %t:\n%s", embedded, tt.secret, got)
+			}
+			if embedded := !strings.Contains(got, `src="link.png"`); embedded != tt.viaLink {
+				t.Errorf("link.png embedded: %t, want %t:\n%s", embedded, tt.viaLink, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package htmlknitter
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// selector is a simple CSS selector: a tag name and/or an #id and .class
+// names, e.g. "div#cookie-banner" or "img.tracking"
+type selector struct {
+	tag     string
+	id      string
+	classes []string
+}
+
+// parseSelector parses a simple selector such as "iframe", "div#id" or
+// "img.class"
+func parseSelector(s string) (selector, error) {
+	var sel selector
+	rest := strings.TrimSpace(s)
+	if rest == "" {
+		return sel, fmt.Errorf("htmlknitter: empty selector")
+	}
+	if strings.ContainsAny(rest, " >+~[]:*,") {
+		return sel, fmt.Errorf("htmlknitter: unsupported selector %q, only tag, #id and .class are supported", s)
+	}
+
+	// Tag name, up to the first # or .
+	i := strings.IndexAny(rest, "#.")
+	if i < 0 {
+		i = len(rest)
+	}
+	sel.tag = strings.ToLower(rest[:i])
+	rest = rest[i:]
+
+	for rest != "" {
+		kind := rest[0]
+		rest = rest[1:]
+		i := strings.IndexAny(rest, "#.")
+		if i < 0 {
+			i = len(rest)
+		}
+		name := rest[:i]
+		rest = rest[i:]
+		if name == "" {
+			return sel, fmt.Errorf("htmlknitter: invalid selector %q", s)
+		}
+		if kind == '#' {
+			sel.id = name
+		} else {
+			sel.classes = append(sel.classes, name)
+		}
+	}
+	return sel, nil
+}
+
+// parseSelectors parses a list of simple selectors
+func parseSelectors(list []string) ([]selector, error) {
+	selectors := make([]selector, 0, len(list))
+	for _, s := range list {
+		sel, err := parseSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, sel)
+	}
+	return selectors, nil
+}
+
+// matches reports whether the element n matches the selector
+func (sel selector) matches(n *html.Node) bool {
+	if n.Type != html.ElementNode || (sel.tag != "" && n.Data != sel.tag) {
+		return false
+	}
+
+	var id, class string
+	for _, a := range n.Attr {
+		switch a.Key {
+		case "id":
+			id = a.Val
+		case "class":
+			class = a.Val
+		}
+	}
+	if sel.id != "" && id != sel.id {
+		return false
+	}
+	classes := strings.Fields(class)
+	for _, want := range sel.classes {
+		found := false
+		for _, c := range classes {
+			if c == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAny reports whether the element n matches any of the selectors
+func matchesAny(selectors []selector, n *html.Node) bool {
+	for _, sel := range selectors {
+		if sel.matches(n) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepMatching reduces the <body> of doc to the elements matching any of the
+// selectors (outermost ones, in document order). The <head> is left as is so
+// the styles and fonts of the page still apply. Returns false when nothing
+// matched.
+func keepMatching(doc *html.Node, selectors []selector) bool {
+	body := findElement(doc, "body")
+	if body == nil {
+		return false
+	}
+
+	var kept []*html.Node
+	var collect func(n *html.Node)
+	collect = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if matchesAny(selectors, c) {
+				kept = append(kept, c)
+				continue
+			}
+			collect(c)
+		}
+	}
+	collect(body)
+
+	for _, n := range kept {
+		n.Parent.RemoveChild(n)
+	}
+	for c := body.FirstChild; c != nil; c = body.FirstChild {
+		body.RemoveChild(c)
+	}
+	for _, n := range kept {
+		body.AppendChild(n)
+	}
+	return len(kept) > 0
+}
@@ -0,0 +1,35 @@
+package htmlknitter
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestKeepElements(t *testing.T) {
+	fsys := fstest.MapFS{
+		"logo.png": {Data: []byte("logo")},
+		"a.png":    {Data: []byte("image a")},
+	}
+	input := `<html><head><title>T</title></head><body>` +
+		`<header><img src="logo.png" alt=""></header>` +
+		`<div class="grid"><div class="card big">A<img src="a.png" alt=""></div><div class="card">B <div class="card">nested</div></div></div>` +
+		`<aside id="promo">P</aside><footer>f</footer></body></html>`
+	got := knitString(t, fsys, input, Options{KeepElements: []string{"#promo", "div.card"}})
+
+	// The outermost matches in document order, with only their assets
+	want := `<head><meta charset="utf-8"/><title>T</title></head><body>` +
+		`<div class="card big">A<img src="data:image/png;base64,` + b64("image a") + `" alt=""/></div>` +
+		`<div class="card">B <div class="card">nested</div></div><aside id="promo">P</aside></body>`
+	if !strings.Contains(got, want) {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	var logs bytes.Buffer
+	got = knitString(t, fsys, input, Options{KeepElements: []string{"#missing"}, Logger: log.New(&logs, "", 0)})
+	if !strings.Contains(got, "<body></body>") || !strings.Contains(logs.String(), "No element matches #missing") {
+		t.Errorf("body not emptied with a warning when nothing matches, logged %q:\n%s", logs.String(), got)
+	}
+}
@@ -0,0 +1,334 @@
+package htmlknitter
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Elements that never have content or an end tag
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+// Start tags ending an element with an optional end tag, when it's the
+// innermost open element, like the next <li> of a list
+var impliedEndTags = map[string]map[string]bool{
+	"li":       {"li": true},
+	"dt":       {"dt": true, "dd": true},
+	"dd":       {"dt": true, "dd": true},
+	"option":   {"option": true, "optgroup": true},
+	"optgroup": {"optgroup": true},
+	"rt":       {"rt": true, "rp": true},
+	"rp":       {"rt": true, "rp": true},
+	"tr":       {"tr": true, "tbody": true, "tfoot": true, "thead": true},
+	"td":       {"td": true, "th": true, "tr": true, "tbody": true, "tfoot": true, "thead": true},
+	"th":       {"td": true, "th": true, "tr": true, "tbody": true, "tfoot": true, "thead": true},
+	"thead":    {"tbody": true, "tfoot": true},
+	"tbody":    {"tbody": true, "tfoot": true},
+	"p": {
+		"address": true, "article": true, "aside": true, "blockquote": true,
+		"dd": true, "details": true, "dialog": true, "div": true, "dl": true,
+		"dt": true, "fieldset": true, "figcaption": true, "figure": true,
+		"footer": true, "form": true, "h1": true, "h2": true, "h3": true,
+		"h4": true, "h5": true, "h6": true, "header": true, "hgroup": true,
+		"hr": true, "li": true, "main": true, "menu": true, "nav": true,
+		"ol": true, "p": true, "pre": true, "section": true, "table": true,
+		"ul": true,
+	},
+}
+
+// checkStreaming returns an error for the options that need the whole
+// document tree, which streaming mode never builds
+func checkStreaming(opts Options) error {
+	unsupported := []struct {
+		set  bool
+		name string
+	}{
+		{len(opts.KeepElements) > 0, "KeepElements"},
+		{opts.UnwrapNoscript, "UnwrapNoscript"},
+		{opts.Minify, "Minify"},
+		{opts.Pretty, "Pretty"},
+		{opts.MergeStyles, "MergeStyles"},
+		{opts.ExtractAssets != "", "ExtractAssets"},
+		{opts.CommentBanner != "", "CommentBanner"},
+		{opts.Charset != "", "Charset"},
+		{opts.BaseHref != "", "BaseHref"},
+		{opts.Verify, "Verify"},
+		{opts.PrefixIDs != "", "PrefixIDs"},
+		{opts.XHTML, "XHTML"},
+		{opts.PruneUnusedFonts, "PruneUnusedFonts"},
+		{opts.WrapDataURLs > 0, "WrapDataURLs"},
+		{opts.CheckAnchors, "CheckAnchors"},
+		{opts.StripDeadAnchors, "StripDeadAnchors"},
+		{opts.Gzip, "Gzip"},
+		{opts.Brotli, "Brotli"},
+	}
+	for _, option := range unsupported {
+		if option.set {
+			return fmt.Errorf("htmlknitter: Streaming can't be combined with %s", option.name)
+		}
+	}
+	return nil
+}
+
+// streamHTML is processHTML for very large documents: the input is read a
+// token at a time and each element is processed on its own and written out
+// right away, so the document is never held in memory.
+func streamHTML(cfg *config) error {
+	// Open input file
+	file, err := os.Open(cfg.InputFile)
+	if err != nil {
+		return &Error{Op: "opening input file", Path: cfg.InputFile, Err: err}
+	}
+	defer file.Close()
+
+	// The output gets the permissions of the input
+	info, err := file.Stat()
+	if err != nil {
+		return &Error{Op: "reading input file", Path: cfg.InputFile, Err: err}
+	}
+	cfg.report.InputSize = info.Size()
+
+	// Write to a temporary file in the output directory which is renamed once
+	// complete, or nowhere in dry-run mode
+	var outFile *os.File
+	out := io.Discard
+	if !cfg.DryRun {
+		outFile, err = os.CreateTemp(filepath.Dir(cfg.OutputFile), "."+filepath.Base(cfg.OutputFile)+".*.tmp")
+		if err != nil {
+			return &Error{Op: "creating output file", Path: cfg.OutputFile, Err: err}
+		}
+		defer os.Remove(outFile.Name()) // no-op once renamed
+		defer outFile.Close()
+		out = outFile
+	}
+	buf := bufio.NewWriter(out)
+	w := &countingWriter{w: buf}
+
+	r, err := maybeGunzip(file)
+	if err != nil {
+		return &Error{Op: "decompressing input file", Path: cfg.InputFile, Err: err}
+	}
+	if err := streamTokens(html.NewTokenizer(r), w, cfg); err != nil {
+		return err
+	}
+	if cfg.err != nil {
+		return &Error{Op: "processing", Path: cfg.InputFile, Err: cfg.err}
+	}
+	if err := cfg.ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && cfg.Timeout > 0 {
+			err = fmt.Errorf("timed out after %s: %w", cfg.Timeout, err)
+		}
+		return &Error{Op: "processing", Path: cfg.InputFile, Err: err}
+	}
+	cfg.report.OutputSize = w.n
+	if err := cfg.checkOutputSize(w.n); err != nil {
+		return err
+	}
+
+	if cfg.DryRun {
+		return nil
+	}
+	if err := buf.Flush(); err != nil {
+		return &Error{Op: "writing output file", Path: cfg.OutputFile, Err: err}
+	}
+	if err := outFile.Chmod(info.Mode().Perm()); err != nil {
+		return &Error{Op: "writing output file", Path: cfg.OutputFile, Err: err}
+	}
+	if err := outFile.Close(); err != nil {
+		return &Error{Op: "writing output file", Path: cfg.OutputFile, Err: err}
+	}
+	if err := os.Rename(outFile.Name(), cfg.OutputFile); err != nil {
+		return &Error{Op: "writing output file", Path: cfg.OutputFile, Err: err}
+	}
+	cfg.report.OutputFiles = append(cfg.report.OutputFiles, cfg.OutputFile)
+	return nil
+}
+
+// streamTokens copies the tokens of z to w, processing elements and comments
+// as processNode would. Tokens left untouched are copied as written.
+func streamTokens(z *html.Tokenizer, w io.Writer, cfg *config) error {
+	var open []string // names of the elements currently open
+	var skip []string // removed element being dropped and its open children
+	inStyle := false  // whether the text that follows is CSS
+
+	for cfg.err == nil && cfg.ctx.Err() == nil {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if err := z.Err(); err != io.EOF {
+				return &Error{Op: "parsing HTML", Path: cfg.InputFile, Err: err}
+			}
+			return nil
+		}
+		raw := z.Raw()
+		var token html.Token
+		if tt == html.StartTagToken || tt == html.SelfClosingTagToken || tt == html.EndTagToken {
+			token = z.Token()
+		}
+
+		// Drop the content of removed elements up to their end tag. Elements
+		// like <li> and <p> may have none, they end at the start tag of a
+		// sibling or the end tag of their parent, which get processed as usual.
+		if len(skip) > 0 {
+			ended := false
+			switch tt {
+			case html.StartTagToken:
+				for len(skip) > 0 && impliedEndTags[skip[len(skip)-1]][token.Data] {
+					skip = skip[:len(skip)-1]
+				}
+				ended = len(skip) == 0
+				if !ended && !voidElements[token.Data] {
+					skip = append(skip, token.Data)
+				}
+			case html.EndTagToken:
+				if i := lastIndex(skip, token.Data); i >= 0 {
+					skip = skip[:i]
+				} else if slices.Contains(open, token.Data) {
+					skip, ended = nil, true
+				}
+			}
+			if !ended {
+				continue
+			}
+		}
+
+		var err error
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			inStyle = tt == html.StartTagToken && token.Data == "style"
+			parent := "body"
+			if len(open) > 0 {
+				parent = open[len(open)-1]
+			}
+
+			nodes, removed := streamElement(token, parent, cfg)
+			hasContent := tt == html.StartTagToken && !voidElements[token.Data]
+			switch {
+			case removed:
+				// Replaced or removed, along with its content
+				err = renderNodes(w, nodes)
+				if hasContent {
+					skip = []string{token.Data}
+					inStyle = false
+				}
+			case nodes == nil && !(cfg.SelfCloseVoid && tt == html.StartTagToken && voidElements[token.Data]):
+				_, err = w.Write(raw)
+			default:
+				if nodes != nil {
+					token.Attr = nodes[0].Attr
+				}
+				if cfg.SelfCloseVoid && voidElements[token.Data] {
+					token.Type = html.SelfClosingTagToken
+				}
+				_, err = io.WriteString(w, token.String())
+			}
+			if hasContent && len(skip) == 0 {
+				open = append(open, token.Data)
+			}
+		case html.EndTagToken:
+			// Close the innermost element of that name, like nested <div>s
+			if i := lastIndex(open, token.Data); i >= 0 {
+				open = open[:i]
+			}
+			inStyle = false
+			_, err = w.Write(raw)
+		case html.TextToken:
+			if inStyle {
+				_, err = io.WriteString(w, processStyleText(string(raw), cfg))
+			} else {
+				_, err = w.Write(raw)
+			}
+		case html.CommentToken:
+			comment := &html.Node{Type: html.CommentNode, Data: string(z.Text())}
+			holder := &html.Node{Type: html.ElementNode, Data: "body"}
+			holder.AppendChild(comment)
+			processNode(comment, cfg)
+			if holder.FirstChild != nil {
+				_, err = w.Write(raw)
+			}
+		default:
+			_, err = w.Write(raw)
+		}
+		if err != nil {
+			return &Error{Op: "writing output file", Path: cfg.OutputFile, Err: err}
+		}
+	}
+	return nil
+}
+
+// streamElement runs processNode on the element of a start tag, placed in a
+// parent element of the given name. It returns nil when the element is left
+// untouched, the element itself when only its attributes changed, or the
+// nodes it got replaced with (possibly none) with removed set.
+func streamElement(token html.Token, parent string, cfg *config) (nodes []*html.Node, removed bool) {
+	// SVG sprites are inlined into a sprite sheet at the start of the body,
+	// which has been written already
+	if token.Data == "use" {
+		return nil, false
+	}
+
+	n := &html.Node{
+		Type:     html.ElementNode,
+		Data:     token.Data,
+		DataAtom: atom.Lookup([]byte(token.Data)),
+		Attr:     slices.Clone(token.Attr),
+	}
+	holder := &html.Node{Type: html.ElementNode, Data: parent, DataAtom: atom.Lookup([]byte(parent))}
+	holder.AppendChild(n)
+	processNode(n, cfg)
+
+	// Elements given content, like inlined scripts, are replaced as well
+	if holder.FirstChild == n && n.NextSibling == nil && n.FirstChild == nil {
+		if slices.Equal(n.Attr, token.Attr) {
+			return nil, false
+		}
+		return []*html.Node{n}, false
+	}
+	for c := holder.FirstChild; c != nil; c = c.NextSibling {
+		nodes = append(nodes, c)
+	}
+	return nodes, true
+}
+
+// lastIndex returns the index of the last occurrence of name in names, or -1
+func lastIndex(names []string, name string) int {
+	for i := len(names) - 1; i >= 0; i-- {
+		if names[i] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// renderNodes renders each of nodes to w
+func renderNodes(w io.Writer, nodes []*html.Node) error {
+	for _, n := range nodes {
+		if err := html.Render(w, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
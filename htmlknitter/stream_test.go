@@ -0,0 +1,45 @@
+package htmlknitter
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestStreamingCopiesAsWritten(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.png":   {Data: []byte("image a")},
+		"app.css": {Data: []byte(`.a{background:url(a.png)}`)},
+	}
+	input := "<!doctype html>\n<HTML><Head><link rel=stylesheet href=app.css></head>\n" +
+		"<BODY class='x'><img src=a.png alt=''>\n<p>one<p>two</BODY></HTML>\n"
+	got, _ := knitFiles(t, fsys, input, Options{Streaming: true})
+
+	want := "<!doctype html>\n<html><head>" +
+		`<style type="text/css">.a{background:url(data:image/png;base64,` + b64("image a") + `)}</style></head>` + "\n" +
+		`<body class='x'><img src="data:image/png;base64,` + b64("image a") + `" alt="">` + "\n" +
+		"<p>one<p>two</body></html>\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestStreamingRemoveOptionalEndTag(t *testing.T) {
+	tests := []struct {
+		remove, input, want string
+	}{
+		{"li.ad", `<ul><li class=ad>x<li>keep</ul>`, `<ul><li>keep</ul>`},
+		{"li.ad", `<ul><li>keep<li class=ad>x</ul><p>after`, `<ul><li>keep</ul><p>after`},
+		{"li.ad", `<ul><li class=ad><ul><li>x<li>y</ul><li>keep</ul>`, `<ul><li>keep</ul>`},
+		{"li.ad", `<ul><li class=ad><p>x<li>keep</ul>`, `<ul><li>keep</ul>`},
+		{"p.ad", `<div><p class=ad>x<div>keep</div></div>`, `<div><div>keep</div></div>`},
+		{"option.ad", `<select><option class=ad>x<option>keep</select>`, `<select><option>keep</select>`},
+		{"div.ad", `<div class=ad><div>x</div>y</div><p>keep`, `<p>keep`},
+	}
+	for _, tt := range tests {
+		input := "<html><body>" + tt.input + "</body></html>"
+		got, _ := knitFiles(t, fstest.MapFS{}, input, Options{Streaming: true, RemoveElements: []string{tt.remove}})
+		if want := "<html><body>" + tt.want + "</body></html>"; got != want {
+			t.Errorf("removing %s from %s:\ngot  %s\nwant %s", tt.remove, tt.input, got, want)
+		}
+	}
+}
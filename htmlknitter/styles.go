@@ -0,0 +1,97 @@
+package htmlknitter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// leadingRuleRegex finds the CSS rules only allowed at the top of a
+// stylesheet
+var leadingRuleRegex = regexp.MustCompile(`(?i)@(import|charset)\b`)
+
+// mergeStyles concatenates the <style> elements of the document into the
+// first one, in document order. Stylesheets that are still linked break the
+// merge, so the cascade is unchanged, and styles are only merged with ones
+// of the same nonce/scoped semantics. Media-scoped styles get wrapped in
+// @media blocks. Styles with @import or @charset rules left, which would be
+// ignored once they're no longer at the top or get wrapped, break the merge
+// too.
+func mergeStyles(doc *html.Node) {
+	var target *html.Node
+	merged := false
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			switch {
+			case c.Type != html.ElementNode:
+			case c.Data == "template" || c.Namespace != "":
+				// Styles of templates and SVG images stay where they are
+			case c.Data == "link" && isStylesheet(c):
+				target, merged = nil, false
+			case c.Data == "style" && isCSSStyle(c) && leadingRuleRegex.MatchString(styleText(c)):
+				target, merged = nil, false
+			case c.Data == "style" && isCSSStyle(c):
+				if target != nil && sameStyleScope(target, c) {
+					if !merged {
+						setStyleText(target, scopedStyleText(target))
+						removeAttr(target, "media")
+						merged = true
+					}
+					setStyleText(target, styleText(target)+"\n"+scopedStyleText(c))
+					c.Parent.RemoveChild(c)
+				} else {
+					target, merged = c, false
+				}
+			default:
+				walk(c)
+			}
+			c = next
+		}
+	}
+	walk(doc)
+}
+
+// isCSSStyle reports whether the <style> element n holds CSS
+func isCSSStyle(n *html.Node) bool {
+	typ := strings.ToLower(strings.TrimSpace(getAttr(n, "type")))
+	return typ == "" || typ == "text/css"
+}
+
+// sameStyleScope reports whether the <style> elements a and b can be merged
+func sameStyleScope(a, b *html.Node) bool {
+	return getAttr(a, "nonce") == getAttr(b, "nonce") && hasAttr(a, "scoped") == hasAttr(b, "scoped")
+}
+
+// styleText returns the CSS of a <style> element
+func styleText(n *html.Node) string {
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.TextNode {
+			b.WriteString(c.Data)
+		}
+	}
+	return b.String()
+}
+
+// scopedStyleText returns the CSS of a <style> element, wrapped in a @media
+// block when the element has a media attribute
+func scopedStyleText(n *html.Node) string {
+	css := styleText(n)
+	if media := strings.TrimSpace(getAttr(n, "media")); media != "" && !strings.EqualFold(media, "all") {
+		return fmt.Sprintf("@media %s {\n%s\n}", media, css)
+	}
+	return css
+}
+
+// setStyleText replaces the content of a <style> element
+func setStyleText(n *html.Node, css string) {
+	for c := n.FirstChild; c != nil; c = n.FirstChild {
+		n.RemoveChild(c)
+	}
+	n.AppendChild(&html.Node{Type: html.TextNode, Data: css})
+}
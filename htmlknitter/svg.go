@@ -0,0 +1,131 @@
+package htmlknitter
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// embedSVGUse inlines the sprite definition referenced by an external
+// <use href="sprite.svg#icon"> into the document and points the element at
+// the local copy instead
+func embedSVGUse(n *html.Node, cfg *config) {
+	for i, a := range n.Attr {
+		if a.Key != "href" && !(a.Namespace == "xlink" && a.Key == "href") {
+			continue
+		}
+
+		ref, id, found := strings.Cut(cfg.rewriteRef(a.Val), "#")
+		if !found || ref == "" || id == "" || !shouldEmbed(ref, cfg) {
+			continue
+		}
+
+		if inlineSVGSymbol(n, ref, id, cfg) {
+			n.Attr[i].Val = "#" + id
+		}
+	}
+}
+
+// inlineSVGSymbol copies the element with the given id from the sprite at ref
+// into the document's sprite sheet, once per sprite and id
+func inlineSVGSymbol(n *html.Node, ref, id string, cfg *config) bool {
+	path := resolvePath(ref, cfg)
+	key := path + "#" + id
+	if cfg.svgSymbols[key] {
+		return true
+	}
+
+	sprite, ok := cfg.sprites[path]
+	if !ok {
+		res, err := loadResource(ref, cfg)
+		if err != nil {
+			cfg.unreadablef(ref, err, "Could not read SVG sprite %s: %v", path, err)
+			cfg.recordExternal(ResourceImage, ref, err.Error())
+			return false
+		}
+		cfg.recordEmbedded(ResourceImage, ref, cfg.imageTypes[".svg"], len(res.data))
+
+		sprite, err = html.Parse(bytes.NewReader(res.data))
+		if err != nil {
+			cfg.warnf("Could not parse SVG sprite %s: %v", path, err)
+			return false
+		}
+		cfg.sprites[path] = sprite
+	}
+
+	symbol := findByID(sprite, id)
+	if symbol == nil {
+		cfg.warnf("Could not find #%s in SVG sprite %s", id, path)
+		return false
+	}
+
+	sheet := spriteSheet(n, cfg)
+	if sheet == nil {
+		return false
+	}
+	symbol.Parent.RemoveChild(symbol)
+	sheet.AppendChild(symbol)
+
+	cfg.svgSymbols[key] = true
+	return true
+}
+
+// spriteSheet returns the hidden <svg> element at the start of the body that
+// holds inlined sprite definitions, creating it on first use
+func spriteSheet(n *html.Node, cfg *config) *html.Node {
+	if cfg.spriteSheet != nil {
+		return cfg.spriteSheet
+	}
+
+	root := n
+	for root.Parent != nil {
+		root = root.Parent
+	}
+	body := findElement(root, "body")
+	if body == nil {
+		return nil
+	}
+
+	cfg.spriteSheet = &html.Node{
+		Type:      html.ElementNode,
+		Data:      "svg",
+		Namespace: "svg",
+		Attr: []html.Attribute{
+			{Key: "style", Val: "display:none"},
+			{Key: "aria-hidden", Val: "true"},
+		},
+	}
+	body.InsertBefore(cfg.spriteSheet, body.FirstChild)
+	return cfg.spriteSheet
+}
+
+// findElement returns the first element with the given tag name under n
+func findElement(n *html.Node, tag string) *html.Node {
+	if n.Type == html.ElementNode && n.Data == tag {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, tag); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// findByID returns the first element with the given id under n
+func findByID(n *html.Node, id string) *html.Node {
+	if n.Type == html.ElementNode {
+		for _, a := range n.Attr {
+			if a.Key == "id" && a.Val == id {
+				return n
+			}
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findByID(c, id); found != nil {
+			return found
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package htmlknitter
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// verifyOutput parses the rendered output back and compares its elements with
+// the processed document, catching transformations that produce markup which
+// doesn't parse as intended, e.g. inlined CSS containing "</style>".
+// Differences are reported as warnings.
+func verifyOutput(output []byte, doc *html.Node, cfg *config, opts ...html.ParseOption) {
+	var parsed *html.Node
+	var err error
+	if cfg.Fragment {
+		parsed, err = parseFragment(output, opts...)
+	} else {
+		parsed, err = html.ParseWithOptions(bytes.NewReader(output), opts...)
+	}
+	if err != nil {
+		cfg.warnf("Output of %s doesn't parse: %v", cfg.InputFile, err)
+		return
+	}
+
+	want := countElements(doc, make(map[string]int))
+	got := countElements(parsed, make(map[string]int))
+	tags := slices.Sorted(maps.Keys(want))
+	for _, tag := range slices.Sorted(maps.Keys(got)) {
+		if _, ok := want[tag]; !ok {
+			tags = append(tags, tag)
+		}
+	}
+
+	var diffs []string
+	for _, tag := range tags {
+		if want[tag] != got[tag] {
+			diffs = append(diffs, fmt.Sprintf("%d <%s> instead of %d", got[tag], tag, want[tag]))
+		}
+	}
+	if len(diffs) > 0 {
+		cfg.warnf("Output of %s doesn't parse back to the same document: %s", cfg.InputFile, strings.Join(diffs, ", "))
+		return
+	}
+	cfg.debugf("Verified output of %s", cfg.InputFile)
+}
+
+// countElements adds the number of elements by tag name under n to counts
+func countElements(n *html.Node, counts map[string]int) map[string]int {
+	if n.Type == html.ElementNode {
+		counts[n.Data]++
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		countElements(c, counts)
+	}
+	return counts
+}
@@ -0,0 +1,99 @@
+package htmlknitter
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/net/html"
+)
+
+// MIME type of web app manifests
+const manifestMimeType = "application/manifest+json"
+
+// Members of a web app manifest listing images by their src
+var manifestImageMembers = []string{"icons", "screenshots"}
+
+// embedManifest inlines the web app manifest referenced by a
+// <link rel="manifest"> element as a data URL, embedding the icons it
+// references. Relative URLs in a manifest are relative to the manifest,
+// which a data URL has no location for, so the manifest is left external
+// unless every image it references could be embedded.
+func embedManifest(n *html.Node, cfg *config) {
+	href := cfg.rewriteRef(getAttr(n, "href"))
+	if !canEmbed(href, ResourceManifest, cfg) {
+		return
+	}
+
+	res, err := loadResource(href, cfg)
+	if err != nil {
+		cfg.unreadablef(href, err, "Could not read manifest file %s: %v", resolvePath(href, cfg), err)
+		cfg.recordExternal(ResourceManifest, href, err.Error())
+		return
+	}
+	var manifest map[string]any
+	if err := json.Unmarshal(res.data, &manifest); err != nil {
+		cfg.warnf("Could not parse manifest file %s: %v", resolvePath(href, cfg), err)
+		cfg.recordExternal(ResourceManifest, href, "invalid JSON")
+		return
+	}
+
+	if err := embedManifestImages(manifest, href, cfg); err != nil {
+		cfg.warnf("Not embedding manifest %s: %v", resolvePath(href, cfg), err)
+		cfg.recordExternal(ResourceManifest, href, err.Error())
+		return
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		cfg.warnf("Could not encode manifest %s: %v", resolvePath(href, cfg), err)
+		return
+	}
+
+	setAttr(n, "href", encodeDataURL(manifestMimeType, data))
+	removeFetchAttributes(n)
+	cfg.recordEmbedded(ResourceManifest, href, manifestMimeType, len(res.data))
+}
+
+// embedManifestImages replaces the src of the icons and screenshots of
+// manifest (including the icons of its shortcuts) with data URLs. Relative
+// references are resolved against the manifest at parent. It fails when an
+// image with a relative reference couldn't be embedded.
+func embedManifestImages(manifest map[string]any, parent string, cfg *config) error {
+	var images []any
+	for _, member := range manifestImageMembers {
+		if list, ok := manifest[member].([]any); ok {
+			images = append(images, list...)
+		}
+	}
+	if shortcuts, ok := manifest["shortcuts"].([]any); ok {
+		for _, shortcut := range shortcuts {
+			if shortcut, ok := shortcut.(map[string]any); ok {
+				if list, ok := shortcut["icons"].([]any); ok {
+					images = append(images, list...)
+				}
+			}
+		}
+	}
+
+	for _, image := range images {
+		image, ok := image.(map[string]any)
+		if !ok {
+			continue
+		}
+		src, ok := image["src"].(string)
+		if !ok || isDataURL(src) {
+			continue
+		}
+		ref := resolveCSSRef(cfg.rewriteRef(src), parent)
+		dataURL, ok := "", false
+		if !cfg.SkipImages && canEmbed(ref, ResourceImage, cfg) {
+			dataURL, ok = assetDataURL(ref, ResourceImage, cfg.imageTypes, cfg)
+		}
+		switch {
+		case ok:
+			image["src"] = dataURL
+		case !isRemote(ref):
+			return fmt.Errorf("icon %s can't be embedded", src)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package htmlknitter
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestManifestImages(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app/site.webmanifest": {Data: []byte(`{"name":"App","icons":[` +
+			`{"src":"icon.png","sizes":"192x192"},` +
+			`{"src":"/static/icon-512.png","sizes":"512x512"}]}`)},
+		"app/icon.png":           {Data: []byte("icon 192")},
+		"static/v2/icon-512.png": {Data: []byte("icon 512")},
+	}
+	input := `<html><head><link rel="manifest" href="app/site.webmanifest"></head><body></body></html>`
+	// Applied twice, the rewrite would look for static/v2/v2/icon-512.png
+	got := knitString(t, fsys, input, Options{
+		EmbedManifest: true,
+		Rewrites:      []Rewrite{{From: "/static/", To: "/static/v2/"}},
+	})
+
+	_, href, ok := strings.Cut(got, `<link rel="manifest" href="`)
+	if !ok {
+		t.Fatalf("manifest link missing:\n%s", got)
+	}
+	mimeType, data, err := decodeDataURL(href[:strings.IndexByte(href, '"')])
+	if err != nil || mimeType != manifestMimeType {
+		t.Fatalf("manifest not embedded (%v):\n%s", err, got)
+	}
+	var manifest struct {
+		Icons []struct{ Src string }
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("invalid manifest %s: %v", data, err)
+	}
+	for i, want := range []string{"icon 192", "icon 512"} {
+		if src := manifest.Icons[i].Src; src != "data:image/png;base64,"+b64(want) {
+			t.Errorf("icon %d has src %s, want %s embedded", i, src, want)
+		}
+	}
+}
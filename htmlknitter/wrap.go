@@ -0,0 +1,52 @@
+package htmlknitter
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// wrapDataURLs hard-wraps the base64 data URLs in the <style> elements of the
+// document at width columns. A CSS string can be continued on the next line
+// with a backslash, so the wrapped URLs are quoted and decode as before.
+// Attributes can't be wrapped that way and are left alone.
+func wrapDataURLs(n *html.Node, width int, cfg *config) {
+	if n.Type == html.ElementNode && n.Data == "style" {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.TextNode {
+				c.Data = wrapCSSDataURLs(c.Data, width, cfg)
+			}
+		}
+		return
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		wrapDataURLs(c, width, cfg)
+	}
+}
+
+// wrapCSSDataURLs wraps the base64 data URLs in the url()s of css
+func wrapCSSDataURLs(css string, width int, cfg *config) string {
+	return cssURLRegex.ReplaceAllStringFunc(css, func(match string) string {
+		ref := cssURLRegex.FindStringSubmatch(match)[1]
+		header, _, found := strings.Cut(ref, ",")
+		if !isDataURL(ref) || !found || !strings.HasSuffix(header, ";base64") || len(ref) <= width {
+			return match
+		}
+		if strings.Contains(ref, `\`) {
+			cfg.warnf("Can't wrap data URL %.40s...: it contains a backslash", ref)
+			return match
+		}
+
+		var b strings.Builder
+		b.Grow(len(ref) + 2*len(ref)/width + len(`url("")`))
+		b.WriteString(`url("`)
+		for len(ref) > width {
+			b.WriteString(ref[:width])
+			b.WriteString("\\\n")
+			ref = ref[width:]
+		}
+		b.WriteString(ref)
+		b.WriteString(`")`)
+		return b.String()
+	})
+}
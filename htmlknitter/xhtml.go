@@ -0,0 +1,93 @@
+package htmlknitter
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Namespace of XHTML elements
+const xhtmlNamespace = "http://www.w3.org/1999/xhtml"
+
+// xmlDeclaration returns the <?xml ...?> declaration the document in data
+// starts with, or "" if it has none
+func xmlDeclaration(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	data = bytes.TrimLeft(data, " \t\r\n")
+	if !bytes.HasPrefix(data, []byte("<?xml")) {
+		return ""
+	}
+	end := bytes.Index(data, []byte("?>"))
+	if end < 0 {
+		return ""
+	}
+	return string(data[:end+2])
+}
+
+// expandSelfClosing rewrites the self-closing tags of non-void elements in
+// data, like <div/>, into a start and an end tag. The HTML parser ignores
+// the slash and would leave the element open, nesting what follows into it.
+func expandSelfClosing(data []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(data))
+	z := html.NewTokenizer(bytes.NewReader(data))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return out.Bytes()
+		}
+		raw := z.Raw()
+		if tt != html.SelfClosingTagToken {
+			out.Write(raw)
+			continue
+		}
+		name, _ := z.TagName()
+		if voidElements[string(name)] {
+			out.Write(raw)
+			continue
+		}
+		// Raw tags end with "/>"
+		out.Write(bytes.TrimRight(raw[:len(raw)-2], " \t\r\n\f"))
+		out.WriteString("></")
+		out.Write(name)
+		out.WriteString(">")
+	}
+}
+
+// prepareXHTML makes the processed document serialize as well-formed XML:
+// the parsed <?xml ?> declaration (which the HTML parser turns into a
+// comment) is dropped to be written back as is, the <html> element gets the
+// XHTML namespace, and scripts and styles containing markup characters are
+// wrapped in CDATA sections.
+func prepareXHTML(doc *html.Node) {
+	for c := doc.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.CommentNode && strings.HasPrefix(c.Data, "?xml") {
+			doc.RemoveChild(c)
+		}
+		c = next
+	}
+	prepareXHTMLNode(doc)
+}
+
+func prepareXHTMLNode(n *html.Node) {
+	if n.Type == html.ElementNode && n.Namespace == "" {
+		switch n.Data {
+		case "html":
+			if !hasAttr(n, "xmlns") {
+				n.Attr = append(n.Attr, html.Attribute{Key: "xmlns", Val: xhtmlNamespace})
+			}
+		case "script", "style":
+			if text := n.FirstChild; text != nil && text.Type == html.TextNode &&
+				strings.ContainsAny(text.Data, "<&") && !strings.Contains(text.Data, "<![CDATA[") {
+				// Comments hide the CDATA markers from HTML parsers
+				text.Data = "/*<![CDATA[*/" + text.Data + "/*]]>*/"
+			}
+			return
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		prepareXHTMLNode(c)
+	}
+}
@@ -0,0 +1,50 @@
+package htmlknitter
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestXHTML(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.png": {Data: []byte("image a")},
+	}
+	input := `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Strict//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-strict.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>T</title>` +
+		`<script>if (a < b && c) {}</script></head>` +
+		`<body><div/><p>after<br/><input type="checkbox" checked="checked"/></p><img src="a.png" alt=""/></body></html>`
+	got := knitString(t, fsys, input, Options{XHTML: true})
+
+	for _, want := range []string{
+		`<?xml version="1.0" encoding="UTF-8"?>` + "\n",
+		`<html xmlns="http://www.w3.org/1999/xhtml">`,
+		`<script>/*<![CDATA[*/if (a < b && c) {}/*]]>*/</script>`,
+		// Self-closing, so the paragraph isn't nested in the div
+		`<div></div><p>after<br/>`,
+		`<input type="checkbox" checked="checked"/>`,
+		`<img src="data:image/png;base64,` + b64("image a") + `" alt=""/>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output lacks %s:\n%s", want, got)
+		}
+	}
+
+	// The output parses as XML
+	d := xml.NewDecoder(strings.NewReader(got))
+	d.Strict = true
+	d.Entity = xml.HTMLEntity
+	for {
+		_, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("output isn't well-formed XML: %v\n%s", err, got)
+		}
+	}
+}
@@ -1,263 +1,510 @@
 package main
 
 import (
-	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
-	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
-	"golang.org/x/net/html"
+	"github.com/ashfame/html-knitter/htmlknitter"
 )
 
-type Config struct {
-	inputFile     string
-	outputFile    string
-	removeJS      bool
-	baseDir       string
-	processedURLs map[string]bool
-}
-
-// Font formats and their MIME types
-var fontMimeTypes = map[string]string{
-	".woff2": "font/woff2",
-	".woff":  "font/woff",
-	".ttf":   "font/ttf",
-	".eot":   "application/vnd.ms-fontobject",
-	".otf":   "font/otf",
-}
-
-// Regular expression to find font face rules and URLs
-var (
-	fontFaceRegex = regexp.MustCompile(`@font-face\s*{[^}]*}`)
-	fontUrlRegex  = regexp.MustCompile(`url\(['"]?(/_next/[^'"()]+)['"]?\)`)
-)
+// Exit status when every file got processed but with warnings, e.g. about
+// assets that couldn't be embedded. Hard failures exit with 1.
+const exitWarnings = 2
 
 func main() {
 	// Parse command line flags
-	inputFile := flag.String("input", "", "Path to input HTML file (required)")
-	outputFile := flag.String("output", "", "Path to output HTML file (required)")
+	configFile := flag.String("config", "", "Read default flag values from this JSON or YAML file (flags given on the command line win)")
+	inputFile := flag.String("input", "", "Path to input HTML file, or a glob / comma-separated list of files (required unless -dir is used)")
+	inputDir := flag.String("dir", "", "Process every HTML file in this directory tree, mirroring it into the -output directory")
+	outputFile := flag.String("output", "", "Path to output HTML file, or output directory when processing multiple files (default: next to each input, see -suffix)")
+	suffix := flag.String("suffix", ".knitted", "Suffix added to the name of each input file to name its output when -output isn't given")
+	dryRun := flag.Bool("dry-run", false, "Report what would change without writing any output")
+	inPlace := flag.Bool("in-place", false, "Overwrite the input files with the processed HTML instead of writing to -output")
+	fragment := flag.Bool("fragment", false, "Treat the input as a HTML snippet, without adding html/head/body wrappers")
+	xhtml := flag.Bool("xhtml", false, "Treat the input as XHTML and keep the output well-formed XML")
+	manifestFile := flag.String("manifest", "", "Write a JSON manifest of the referenced resources to this path")
+	assetRoot := flag.String("asset-root", "", "Directory rooted asset paths like /_next/... are resolved against (default: the directory of each input file)")
+	publicPrefix := flag.String("public-prefix", "/", "Only embed rooted asset paths starting with this prefix, e.g. /_next")
+	noFollowSymlinks := flag.Bool("no-follow-symlinks", false, "Refuse to read assets through symbolic links")
+	extractAssets := flag.String("extract-assets", "", "Write the data: URLs of the output to files in this directory and reference those instead")
+
+	var rewriteFlags stringList
+	flag.Var(&rewriteFlags, "rewrite", "Rewrite asset URLs starting with a prefix before resolving them, e.g. https://example.com/_next=/_next (repeatable)")
+	var mimeFlags stringList
+	flag.Var(&mimeFlags, "mime", "Add or override the MIME type of a font or image extension, e.g. .avif=image/avif (repeatable)")
+	var excludes stringList
+	flag.Var(&excludes, "exclude", "Never embed assets matching this glob, e.g. '*.mp4' or '/_next/media/hero-*' (repeatable)")
+	var ignoreMissing stringList
+	flag.Var(&ignoreMissing, "ignore-missing", "Don't warn about missing assets matching this glob, e.g. '/dev/*' (repeatable)")
+	var removeTags stringList
+	flag.Var(&removeTags, "remove-tag", "Remove elements matching a selector like iframe, div#id or img.class (repeatable)")
+	var keepSelectors stringList
+	flag.Var(&keepSelectors, "keep-selector", "Only keep the body elements matching a selector like main or div#content (repeatable)")
+	checkAnchors := flag.Bool("check-anchors", false, "Warn about links to a #fragment that no element of the output has as id")
+	stripDeadAnchors := flag.Bool("strip-dead-anchors", false, "Remove the href of links to a #fragment that no element of the output has as id")
+	prefixIDs := flag.String("prefix-ids", "", "Add this prefix to every id and the references to it, so the output can be embedded into another page")
 	removeJS := flag.Bool("remove-js", false, "Remove all JavaScript code and references")
+	keepJSInline := flag.Bool("keep-js-inline", false, "Remove external <script src> scripts, JS preload links and event handlers, keeping inline <script> blocks")
+	removeNextData := flag.Bool("remove-next-data", false, "Remove the Next.js <script id=\"__NEXT_DATA__\"> page data, leaving other scripts alone")
+	stripResourceHints := flag.Bool("strip-resource-hints", false, "Remove <link rel=\"preconnect\">, dns-prefetch, prefetch and prerender hints")
+	unwrapNoscript := flag.Bool("unwrap-noscript", false, "Replace <noscript> elements with their content when removing JavaScript")
+	embedList := flag.String("embed", strings.Join(defaultEmbedTypes, ","), "Comma-separated resource types to embed, out of "+strings.Join(embedTypeNames, ", "))
+	noEmbedList := flag.String("no-embed", "", "Comma-separated resource types not to embed, taken out of -embed")
+	inlineJS := flag.Bool("inline-js", false, "Inline external JavaScript files into the HTML")
+	nonce := flag.String("nonce", "", "Add this CSP nonce to the <style> and <script> elements of inlined stylesheets and scripts")
+	noInlineCSS := flag.Bool("no-inline-css", false, "Keep stylesheets as external references instead of inlining them")
+	noEmbedFonts := flag.Bool("no-embed-fonts", false, "Keep fonts referenced by inlined CSS as external references")
+	embedImages := flag.Bool("embed-images", true, "Embed images as base64 data URLs")
+	embedMedia := flag.Bool("embed-media", false, "Embed audio/video files referenced by <video>/<audio> (up to -max-embed-size, or 1 MiB when unset)")
+	maxEmbedSize := flag.Int64("max-embed-size", 0, "Leave fonts, images and media files larger than this many bytes external (default no limit)")
+	maxOutputSize := flag.Int64("max-output-size", 0, "Fail without writing the output when it's larger than this many bytes (default no limit)")
+	embedFavicon := flag.Bool("embed-favicon", true, "Embed favicons and touch icons as base64 data URLs")
+	embedManifest := flag.Bool("embed-manifest", false, "Inline <link rel=\"manifest\"> web app manifests and the icons they reference")
+	embedMetaImages := flag.Bool("embed-meta-images", false, "Embed the og:image and twitter:image images of social preview <meta> tags (most social networks can't read data URLs)")
+	inlineIframes := flag.Bool("inline-iframes", false, "Knit the local HTML files referenced by <iframe src> into their srcdoc attribute")
+	maxIframeDepth := flag.Int("max-iframe-depth", 3, "Number of levels of nested iframes inlined by -inline-iframes")
+	fetchRemote := flag.Bool("fetch-remote", false, "Download and embed assets referenced by http/https URLs")
+	fetchTimeout := flag.Duration("fetch-timeout", 30*time.Second, "Timeout for each remote download")
+	timeout := flag.Duration("timeout", 0, "Timeout for processing each file, no output is written when exceeded (default no limit)")
+	preferWOFF2 := flag.Bool("prefer-woff2", false, "Only embed the woff2 source of fonts listing several formats")
+	pruneUnusedFonts := flag.Bool("prune-unused-fonts", false, "Drop the @font-face rules of font families never mentioned in the HTML or CSS")
+	minify := flag.Bool("minify", false, "Minify the output HTML")
+	pretty := flag.Bool("pretty", false, "Indent the output HTML for readability")
+	selfCloseVoid := flag.Bool("self-close-void", false, "Self-close void elements like <br/> in -streaming mode too (always the case otherwise)")
+	indentDataURLs := flag.Int("indent-data-urls", 0, "Wrap the base64 data URLs in <style> elements at this many columns, e.g. 76, for debugging")
+	minifyCSS := flag.Bool("minify-css", false, "Minify inlined CSS")
+	mergeStyles := flag.Bool("merge-styles", false, "Merge all <style> elements into a single one")
+	stripComments := flag.Bool("strip-comments", false, "Remove HTML comments (conditional comments are kept)")
+	lang := flag.String("lang", "", "Set the lang attribute of the <html> element, e.g. en")
+	baseHref := flag.String("base-href", "", "Add a <base href> with this URL to the <head>, so relative links resolve against it")
+	charset := flag.String("charset", "", "Declare this character encoding in the <meta charset> of the output (default: keep the input's, or add utf-8 when missing)")
+	commentBanner := flag.String("comment-banner", "", "Add a comment with this text at the top of the output, {input}, {date} and {time} are replaced with the input file name, date and time")
+	stripConditionalComments := flag.Bool("strip-conditional-comments", false, "Also remove conditional comments when stripping comments")
+	concurrency := flag.Int("concurrency", 0, "Number of assets to load and encode in parallel (default GOMAXPROCS)")
+	gzipOutput := flag.Bool("gzip", false, "Also write a gzip-compressed copy of the output (.gz)")
+	brotliOutput := flag.Bool("brotli", false, "Also write a brotli-compressed copy of the output (.br)")
+	compressionLevel := flag.Int("compression-level", 0, "Compression level for -gzip/-brotli (default: each format's default)")
+	compressOnly := flag.Bool("compress-only", false, "Only write the compressed copies of the output")
+	verify := flag.Bool("verify", false, "Parse the output back and warn when it doesn't match the processed document (fail with -strict)")
+	streaming := flag.Bool("streaming", false, "Process the input a tag at a time with little memory, for very large files (not supported with -keep-selector, -unwrap-noscript, -minify, -pretty, -merge-styles, -extract-assets, -comment-banner, -charset, -base-href, -verify, -prefix-ids, -xhtml, -prune-unused-fonts, -indent-data-urls, -check-anchors, -strip-dead-anchors, -gzip or -brotli)")
+	strict := flag.Bool("strict", false, "Fail instead of warning when an asset can't be embedded")
+	verbose := flag.Bool("verbose", false, "Log every asset embedded along with its size")
+	quiet := flag.Bool("quiet", false, "Only log errors")
 	flag.Parse()
 
-	if *inputFile == "" || *outputFile == "" {
-		log.Fatal("Both input and output file paths are required")
+	if *configFile != "" {
+		if err := loadConfig(expandEnv(*configFile)); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	// Create configuration
-	config := &Config{
-		inputFile:     *inputFile,
-		outputFile:    *outputFile,
-		removeJS:      *removeJS,
-		baseDir:       filepath.Dir(*inputFile),
-		processedURLs: make(map[string]bool),
+	// Expand environment variables in paths, e.g. -asset-root $BUILD_DIR/out
+	for _, path := range []*string{inputFile, inputDir, outputFile, manifestFile, assetRoot, extractAssets} {
+		*path = expandEnv(*path)
 	}
 
-	// Process the HTML file
-	if err := processHTML(config); err != nil {
-		log.Fatal(err)
+	if *inputFile == "" && *inputDir == "" {
+		log.Fatal("An input file path is required")
 	}
-
-	absPath, err := filepath.Abs(*outputFile)
+	if *inputDir != "" && *outputFile == "" && !*dryRun && !*inPlace {
+		log.Fatal("An output directory is required with -dir")
+	}
+	if *inputFile != "" && *inputDir != "" {
+		log.Fatal("The -input and -dir flags are mutually exclusive")
+	}
+	if *inPlace && *outputFile != "" && filepath.Clean(*outputFile) != filepath.Clean(*inputFile+*inputDir) {
+		log.Fatal("The -in-place flag can't be combined with a different -output")
+	}
+	embed, err := parseEmbedTypes(*embedList, *noEmbedList)
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Printf("Processed HTML file written to: %s\n", absPath)
-}
+	// The flags predating -embed win over it when given
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for _, legacy := range []struct {
+		flag, embedType string
+		embed           bool
+	}{
+		{"no-inline-css", "css", !*noInlineCSS},
+		{"no-embed-fonts", "fonts", !*noEmbedFonts},
+		{"embed-images", "images", *embedImages},
+		{"embed-favicon", "favicon", *embedFavicon},
+		{"embed-media", "media", *embedMedia},
+		{"embed-manifest", "manifest", *embedManifest},
+		{"inline-js", "js", *inlineJS},
+	} {
+		if given[legacy.flag] {
+			embed[legacy.embedType] = legacy.embed
+		}
+	}
 
-func processHTML(config *Config) error {
-	// Read input file
-	file, err := os.Open(config.inputFile)
-	if err != nil {
-		return fmt.Errorf("error opening input file: %w", err)
+	if *removeJS && embed["js"] {
+		log.Fatal("The -remove-js flag can't be combined with inlining JavaScript (-inline-js or -embed js)")
+	}
+	if *keepJSInline && embed["js"] {
+		log.Fatal("The -keep-js-inline flag can't be combined with inlining JavaScript (-inline-js or -embed js)")
+	}
+	if *minify && *pretty {
+		log.Fatal("The -minify and -pretty flags are mutually exclusive")
+	}
+	if *verbose && *quiet {
+		log.Fatal("The -verbose and -quiet flags are mutually exclusive")
 	}
-	defer file.Close()
 
-	// Parse HTML
-	doc, err := html.Parse(file)
+	rewrites, err := parseRewrites(rewriteFlags)
 	if err != nil {
-		return fmt.Errorf("error parsing HTML: %w", err)
+		log.Fatal(err)
 	}
-
-	// Process the document
-	processNode(doc, config)
-
-	// Create output file
-	outFile, err := os.Create(config.outputFile)
+	mimeTypes, err := parseMIMETypes(mimeFlags)
 	if err != nil {
-		return fmt.Errorf("error creating output file: %w", err)
+		log.Fatal(err)
 	}
-	defer outFile.Close()
 
-	// Write the processed HTML
-	if err := html.Render(outFile, doc); err != nil {
-		return fmt.Errorf("error writing output file: %w", err)
+	// Reproducible builds pin the time through SOURCE_DATE_EPOCH
+	var bannerTime time.Time
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid SOURCE_DATE_EPOCH %q: %v", epoch, err)
+		}
+		bannerTime = time.Unix(seconds, 0).UTC()
 	}
 
-	return nil
-}
+	logLevel := htmlknitter.LogNormal
+	if *verbose {
+		logLevel = htmlknitter.LogVerbose
+	} else if *quiet {
+		logLevel = htmlknitter.LogQuiet
+	}
 
-func processNode(n *html.Node, config *Config) {
-	if n.Type == html.ElementNode {
-		switch n.Data {
-		case "script":
-			if config.removeJS {
-				// Mark node for removal
-				n.Parent.RemoveChild(n)
-				return
-			}
-		case "link":
-			if isPreloadJS(n) && config.removeJS {
-				// Remove preload links for JS files
-				n.Parent.RemoveChild(n)
-				return
-			} else if isStylesheet(n) {
-				// Embed CSS
-				embedCSS(n, config)
+	opts := htmlknitter.Options{
+		DryRun:                   *dryRun,
+		Fragment:                 *fragment,
+		XHTML:                    *xhtml,
+		BaseDir:                  *assetRoot,
+		NoFollowSymlinks:         *noFollowSymlinks,
+		PublicPrefix:             *publicPrefix,
+		Rewrites:                 rewrites,
+		RemoveJS:                 *removeJS,
+		RemoveExternalJS:         *keepJSInline,
+		RemoveNextData:           *removeNextData,
+		StripResourceHints:       *stripResourceHints,
+		RemoveElements:           removeTags,
+		KeepElements:             keepSelectors,
+		PrefixIDs:                *prefixIDs,
+		CheckAnchors:             *checkAnchors,
+		StripDeadAnchors:         *stripDeadAnchors,
+		UnwrapNoscript:           *unwrapNoscript,
+		InlineJS:                 embed["js"],
+		Nonce:                    *nonce,
+		SkipCSS:                  !embed["css"],
+		SkipFonts:                !embed["fonts"],
+		SkipImages:               !embed["images"],
+		SkipFavicon:              !embed["favicon"],
+		EmbedMedia:               embed["media"],
+		EmbedManifest:            embed["manifest"],
+		InlineIframes:            *inlineIframes,
+		EmbedMetaImages:          *embedMetaImages,
+		MaxIframeDepth:           *maxIframeDepth,
+		MaxEmbedSize:             *maxEmbedSize,
+		MaxOutputSize:            *maxOutputSize,
+		Exclude:                  excludes,
+		IgnoreMissing:            ignoreMissing,
+		MIMETypes:                mimeTypes,
+		ExtractAssets:            *extractAssets,
+		FetchRemote:              *fetchRemote,
+		FetchTimeout:             *fetchTimeout,
+		Timeout:                  *timeout,
+		Minify:                   *minify,
+		Pretty:                   *pretty,
+		WrapDataURLs:             *indentDataURLs,
+		SelfCloseVoid:            *selfCloseVoid,
+		MinifyCSS:                *minifyCSS,
+		MergeStyles:              *mergeStyles,
+		PreferWOFF2:              *preferWOFF2,
+		PruneUnusedFonts:         *pruneUnusedFonts,
+		Strict:                   *strict,
+		Streaming:                *streaming,
+		Verify:                   *verify,
+		Gzip:                     *gzipOutput,
+		Brotli:                   *brotliOutput,
+		CompressionLevel:         *compressionLevel,
+		CompressOnly:             *compressOnly,
+		StripComments:            *stripComments,
+		StripConditionalComments: *stripConditionalComments,
+		CommentBanner:            *commentBanner,
+		BannerTime:               bannerTime,
+		Charset:                  *charset,
+		Lang:                     *lang,
+		BaseHref:                 *baseHref,
+		Concurrency:              *concurrency,
+		LogLevel:                 logLevel,
+		Cache:                    htmlknitter.NewCache(),
+	}
+
+	var inputs, outputs []string
+	if *inputDir != "" {
+		// Process a directory tree
+		outputDir := *outputFile
+		if *inPlace {
+			outputDir = *inputDir
+		}
+		if err := checkInputDir(*inputDir); err != nil {
+			log.Fatal(err)
+		}
+		inputs, outputs, err = walkDir(*inputDir, outputDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Pages may share the assets of the whole tree
+		opts.AllowedDirs = []string{*inputDir}
+	} else {
+		inputs, err = expandInputs(*inputFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, input := range inputs {
+			if err := checkInput(input); err != nil {
+				log.Fatal(err)
 			}
 		}
 
-		// Remove inline JavaScript attributes if removeJS is true
-		if config.removeJS {
-			removeInlineJS(n)
+		// Write the files over themselves, next to themselves, to the given
+		// output file or into the output directory
+		switch {
+		case *inPlace:
+			outputs = inputs
+		case *outputFile == "":
+			outputs, err = suffixedPaths(inputs, *suffix)
+		case len(inputs) == 1 && !isOutputDir(*outputFile):
+			outputs = []string{*outputFile}
+		default:
+			outputs, err = outputPaths(inputs, *outputFile)
+		}
+		if err == nil && !*inPlace {
+			err = checkOverwrites(inputs, outputs)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Process a single HTML file, creating the output directory it may
+		// go into like for several files
+		if len(inputs) == 1 {
+			if !opts.DryRun {
+				if err := os.MkdirAll(filepath.Dir(outputs[0]), 0755); err != nil {
+					log.Fatal(err)
+				}
+			}
+			report, err := knitFile(inputs[0], outputs[0], opts)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := writeManifest(*manifestFile, []manifestEntry{newManifestEntry(inputs[0], outputs[0], report)}); err != nil {
+				log.Fatal(err)
+			}
+			if report.Warnings > 0 {
+				os.Exit(exitWarnings)
+			}
+			return
 		}
 	}
 
-	// Process child nodes
-	for c := n.FirstChild; c != nil; {
-		next := c.NextSibling
-		processNode(c, config)
-		c = next
+	entries, failed, warned := knitAll(inputs, outputs, opts)
+	if err := writeManifest(*manifestFile, entries); err != nil {
+		log.Fatal(err)
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d files failed", failed, len(inputs))
+	}
+	if warned > 0 {
+		os.Exit(exitWarnings)
 	}
 }
 
-func embedCSS(n *html.Node, config *Config) {
-	var href string
-	for _, a := range n.Attr {
-		if a.Key == "href" {
-			href = a.Val
-			break
-		}
+// knitFile processes a single HTML file and reports where it was written, or
+// what would change in dry-run mode
+func knitFile(input, output string, opts htmlknitter.Options) (*htmlknitter.Report, error) {
+	opts.InputFile = input
+	opts.OutputFile = output
+	report, err := htmlknitter.Knit(opts)
+	if err != nil {
+		return nil, err
 	}
 
-	if href == "" {
-		return
+	if opts.DryRun {
+		printSummary(input, report)
+		return report, nil
 	}
 
-	// Handle paths starting with /_next
-	if strings.HasPrefix(href, "/_next") {
-		href = filepath.Join(config.baseDir, href)
+	if opts.LogLevel < htmlknitter.LogNormal {
+		return report, nil
+	}
+	for _, path := range report.OutputFiles {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Processed HTML file written to: %s\n", absPath)
 	}
+	printSummary(input, report)
+	return report, nil
+}
 
-	// Read CSS file
-	cssContent, err := os.ReadFile(href)
-	if err != nil {
-		log.Printf("Warning: Could not read CSS file %s: %v", href, err)
-		return
-	}
-
-	// Process font face rules
-	cssString := string(cssContent)
-	fontFaces := fontFaceRegex.FindAllString(cssString, -1)
-
-	for _, fontFace := range fontFaces {
-		urls := fontUrlRegex.FindAllStringSubmatch(fontFace, -1)
-		for _, url := range urls {
-			if len(url) >= 2 {
-				fontPath := url[1]
-				fullPath := filepath.Join(config.baseDir, fontPath)
-
-				// Read font file
-				fontContent, err := os.ReadFile(fullPath)
-				if err != nil {
-					log.Printf("Warning: Could not read font file %s: %v", fullPath, err)
-					continue
-				}
+// printSummary writes a summary of the changes made to a file to stderr, in
+// a single write so summaries of files processed concurrently don't mix
+func printSummary(input string, report *htmlknitter.Report) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s:\n", input)
+	fmt.Fprintf(&b, "  Stylesheets inlined: %d (%s)\n", report.StylesheetsInlined, formatSize(report.StylesheetsSize))
+	fmt.Fprintf(&b, "  Fonts embedded:      %d (%s)\n", report.FontsEmbedded, formatSize(report.FontsSize))
+	fmt.Fprintf(&b, "  Images embedded:     %d (%s)\n", report.ImagesEmbedded, formatSize(report.ImagesSize))
+	fmt.Fprintf(&b, "  Media embedded:      %d (%s)\n", report.MediaEmbedded, formatSize(report.MediaSize))
+	fmt.Fprintf(&b, "  Scripts removed:     %d\n", report.ScriptsRemoved)
+	fmt.Fprintf(&b, "  Scripts inlined:     %d (%s)\n", report.ScriptsInlined, formatSize(report.ScriptsSize))
+	if report.AssetsExtracted > 0 {
+		fmt.Fprintf(&b, "  Assets extracted:    %d\n", report.AssetsExtracted)
+	}
+	fmt.Fprintf(&b, "  Output size:         %s\n", formatSize(report.OutputSize))
+	os.Stderr.WriteString(b.String())
+}
 
-				// Determine MIME type
-				ext := strings.ToLower(filepath.Ext(fontPath))
-				mimeType, ok := fontMimeTypes[ext]
-				if !ok {
-					log.Printf("Warning: Unknown font type %s", ext)
-					continue
-				}
+// formatSize formats a size in bytes for humans
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
 
-				// Convert to base64
-				b64Content := base64.StdEncoding.EncodeToString(fontContent)
-				dataURL := fmt.Sprintf("data:%s;base64,%s", mimeType, b64Content)
+// checkInput makes sure the input file exists and is readable, with errors
+// pointing out the common mistakes
+func checkInput(path string) error {
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("input file %s not found", path)
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("permission denied accessing input file %s", path)
+	case err != nil:
+		return err
+	case info.IsDir():
+		return fmt.Errorf("input %s is a directory, use -dir to process the HTML files in it", path)
+	}
 
-				// Replace URL in CSS
-				cssString = strings.Replace(cssString, url[1], dataURL, -1)
-			}
-		}
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrPermission) {
+		return fmt.Errorf("permission denied reading input file %s", path)
 	}
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
 
-	// Create new style node
-	styleNode := &html.Node{
-		Type: html.ElementNode,
-		Data: "style",
-		Attr: []html.Attribute{
-			{Key: "type", Val: "text/css"},
-		},
+// checkInputDir makes sure the -dir input exists and is a directory
+func checkInputDir(path string) error {
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("input directory %s not found", path)
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("permission denied accessing input directory %s", path)
+	case err != nil:
+		return err
+	case !info.IsDir():
+		return fmt.Errorf("input %s is not a directory, use -input to process a single file", path)
 	}
+	return nil
+}
 
-	// Add CSS content
-	styleNode.AppendChild(&html.Node{
-		Type: html.TextNode,
-		Data: cssString,
+// expandEnv replaces $VAR and ${VAR} in s with the value of the environment
+// variable, and $$ with a literal $
+func expandEnv(s string) string {
+	return os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		return os.Getenv(name)
 	})
-
-	// Replace link node with style node
-	n.Parent.InsertBefore(styleNode, n)
-	n.Parent.RemoveChild(n)
 }
 
-func isPreloadJS(n *html.Node) bool {
-	var rel, as string
-	for _, a := range n.Attr {
-		switch a.Key {
-		case "rel":
-			rel = a.Val
-		case "as":
-			as = a.Val
+// parseRewrites parses -rewrite values of the form from=to
+func parseRewrites(values []string) ([]htmlknitter.Rewrite, error) {
+	rewrites := make([]htmlknitter.Rewrite, 0, len(values))
+	for _, value := range values {
+		from, to, found := strings.Cut(value, "=")
+		if !found || from == "" {
+			return nil, fmt.Errorf("invalid -rewrite %q, expected from=to", value)
 		}
+		rewrites = append(rewrites, htmlknitter.Rewrite{From: from, To: to})
 	}
-	return rel == "preload" && as == "script"
+	return rewrites, nil
 }
 
-func isStylesheet(n *html.Node) bool {
-	for _, a := range n.Attr {
-		if a.Key == "rel" && a.Val == "stylesheet" {
-			return true
+// parseMIMETypes parses -mime values of the form .ext=type
+func parseMIMETypes(values []string) (map[string]string, error) {
+	mimeTypes := make(map[string]string, len(values))
+	for _, value := range values {
+		ext, mimeType, found := strings.Cut(value, "=")
+		if !found || len(ext) < 2 || !strings.HasPrefix(ext, ".") || !strings.Contains(mimeType, "/") {
+			return nil, fmt.Errorf("invalid -mime %q, expected .ext=type/subtype", value)
 		}
+		mimeTypes[ext] = mimeType
 	}
-	return false
+	return mimeTypes, nil
 }
 
-func removeInlineJS(n *html.Node) {
-	// List of JavaScript event attributes to remove
-	jsAttributes := []string{
-		"onclick", "onload", "onunload", "onchange", "onsubmit", "onreset",
-		"onselect", "onblur", "onfocus", "onkeydown", "onkeypress", "onkeyup",
-		"onmouseover", "onmouseout", "onmousedown", "onmouseup", "onmousemove",
-	}
-
-	// Create new attribute list without JavaScript events
-	newAttrs := make([]html.Attribute, 0, len(n.Attr))
-	for _, attr := range n.Attr {
-		isJSAttr := false
-		for _, jsAttr := range jsAttributes {
-			if attr.Key == jsAttr {
-				isJSAttr = true
-				break
+// Resource types -embed and -no-embed take, and the ones embedded by default
+var (
+	embedTypeNames    = []string{"css", "fonts", "images", "favicon", "media", "manifest", "js"}
+	defaultEmbedTypes = []string{"css", "fonts", "images", "favicon"}
+)
+
+// parseEmbedTypes returns the set of resource types to embed: the ones
+// listed by embed, minus the ones listed by noEmbed
+func parseEmbedTypes(embed, noEmbed string) (map[string]bool, error) {
+	types := make(map[string]bool, len(embedTypeNames))
+	for _, list := range []struct {
+		flag, value string
+	}{{"embed", embed}, {"no-embed", noEmbed}} {
+		for _, name := range strings.Split(list.value, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
 			}
-		}
-		if !isJSAttr {
-			newAttrs = append(newAttrs, attr)
+			if !slices.Contains(embedTypeNames, name) {
+				return nil, fmt.Errorf("invalid -%s type %q, expected one of %s", list.flag, name, strings.Join(embedTypeNames, ", "))
+			}
+			types[name] = list.flag == "embed"
 		}
 	}
-	n.Attr = newAttrs
+	return types, nil
+}
+
+// stringList is a flag that can be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/ashfame/html-knitter/htmlknitter"
+)
+
+// manifestEntry lists the resources referenced by one processed file
+type manifestEntry struct {
+	Input     string                 `json:"input"`
+	Output    string                 `json:"output,omitempty"`
+	Resources []htmlknitter.Resource `json:"resources"`
+}
+
+func newManifestEntry(input, output string, report *htmlknitter.Report) manifestEntry {
+	resources := report.Resources
+	if resources == nil {
+		resources = []htmlknitter.Resource{}
+	}
+	return manifestEntry{Input: input, Output: output, Resources: resources}
+}
+
+// writeManifest writes the manifest entries as JSON to path, if one was given
+func writeManifest(path string, entries []manifestEntry) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}